@@ -2,6 +2,8 @@ package godist
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -9,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/zhuangsirui/binpacker"
 	"github.com/zhuangsirui/godist/base"
@@ -17,6 +20,15 @@ import (
 
 const EPMD_PORT = 2613
 
+const (
+	DEFAULT_TICK_INTERVAL = 15 * time.Second
+	DEFAULT_TICK_MISSED   = 4
+	// 单条请求或者应答的默认最大长度。
+	DEFAULT_MAX_MESSAGE_SIZE = 64 << 20
+	// 对端拒绝本节点的连接之后，等待对端的连接登记的最长时间。
+	PEER_CONNECT_TIMEOUT = 5 * time.Second
+)
+
 var (
 	endian         = binary.LittleEndian
 	routineCounter uint64
@@ -26,16 +38,60 @@ var (
 // 针对所有节点的链接。
 type Agent struct {
 	node           *base.Node
+	creation       uint32
 	gpmd           base.GPMD
 	nodes          map[string]*base.Node
 	nodeLock       *sync.RWMutex
 	routines       map[base.RoutineId]*base.Routine
 	routineLock    *sync.RWMutex
-	connections    map[string]*net.TCPConn
+	names          map[string]base.RoutineId
+	routineNames   map[base.RoutineId]string
+	nameLock       *sync.RWMutex
+	globals        map[string]base.Pid
+	globalLock     *sync.RWMutex
+	globalResolver GlobalResolver
+	groups         map[string]map[base.Pid]bool
+	groupLock      *sync.RWMutex
+	monitors       map[base.RoutineId]map[monitorKey]base.Pid
+	watching       map[base.MonitorRef]watch
+	links          map[base.RoutineId]map[base.Pid]bool
+	monitorLock    *sync.RWMutex
+	monitorCounter uint64
+	nodeEvents     map[uint64]chan NodeEvent
+	eventLock      *sync.RWMutex
+	eventCounter   uint64
+	connections    map[string]*connection
+	dialing        map[string]bool
 	connectionLock *sync.RWMutex
 	listener       *net.TCPListener
+	tickInterval   time.Duration
+	tickMissed     int
+	maxMessageSize uint64
+	compressors    []Compressor
+	compressMin    int
+	tlsConfig      *tls.Config
+	cookie         []byte
+	capabilities   uint64
+	retryPolicy    *ReconnectPolicy
+	outbox         map[string][]outboxEntry
+	outboxLock     *sync.Mutex
+	codecs         map[byte]Codec
+	codecLock      *sync.RWMutex
+	defaultCodec   byte
+	spawnables     map[string]SpawnFactory
+	spawnLock      *sync.RWMutex
+	spawnLinks     map[*spawnLink]bool
+	funcs          map[string]RPCFunc
+	funcLock       *sync.RWMutex
+	timers         map[TimerRef]*timer
+	routineTimers  map[base.RoutineId]map[TimerRef]bool
+	timerLock      *sync.Mutex
+	timerCounter   uint64
 	routineCounter *uint64
-	isStop         bool
+	calls          map[uint64]chan []byte
+	callLock       *sync.Mutex
+	callCounter    uint64
+	isStop         atomic.Bool
 	stopped        chan bool
 }
 
@@ -52,20 +108,59 @@ func New(node string) *Agent {
 			Name: nameAndHost[0],
 			Host: nameAndHost[1],
 		},
+		creation:       newCreation(),
 		gpmd:           gpmd,
 		nodes:          make(map[string]*base.Node),
 		nodeLock:       new(sync.RWMutex),
 		routines:       make(map[base.RoutineId]*base.Routine),
 		routineLock:    new(sync.RWMutex),
-		connections:    make(map[string]*net.TCPConn),
+		names:          make(map[string]base.RoutineId),
+		routineNames:   make(map[base.RoutineId]string),
+		nameLock:       new(sync.RWMutex),
+		globals:        make(map[string]base.Pid),
+		globalLock:     new(sync.RWMutex),
+		globalResolver: DefaultGlobalResolver,
+		groups:         make(map[string]map[base.Pid]bool),
+		groupLock:      new(sync.RWMutex),
+		monitors:       make(map[base.RoutineId]map[monitorKey]base.Pid),
+		watching:       make(map[base.MonitorRef]watch),
+		links:          make(map[base.RoutineId]map[base.Pid]bool),
+		monitorLock:    new(sync.RWMutex),
+		nodeEvents:     make(map[uint64]chan NodeEvent),
+		eventLock:      new(sync.RWMutex),
+		connections:    make(map[string]*connection),
+		dialing:        make(map[string]bool),
 		connectionLock: new(sync.RWMutex),
+		tickInterval:   DEFAULT_TICK_INTERVAL,
+		tickMissed:     DEFAULT_TICK_MISSED,
+		maxMessageSize: DEFAULT_MAX_MESSAGE_SIZE,
+		capabilities:   CAPABILITIES,
+		outbox:         make(map[string][]outboxEntry),
+		outboxLock:     new(sync.Mutex),
+		codecs: map[byte]Codec{
+			CODEC_GOB:    GobCodec,
+			CODEC_JSON:   JSONCodec,
+			CODEC_BINARY: BinaryCodec,
+		},
+		codecLock:      new(sync.RWMutex),
+		defaultCodec:   CODEC_GOB,
+		spawnables:     make(map[string]SpawnFactory),
+		spawnLock:      new(sync.RWMutex),
+		spawnLinks:     make(map[*spawnLink]bool),
+		funcs:          make(map[string]RPCFunc),
+		funcLock:       new(sync.RWMutex),
+		timers:         make(map[TimerRef]*timer),
+		routineTimers:  make(map[base.RoutineId]map[TimerRef]bool),
+		timerLock:      new(sync.Mutex),
 		routineCounter: &routineCounter,
+		calls:          make(map[uint64]chan []byte),
+		callLock:       new(sync.Mutex),
 		stopped:        make(chan bool, 1),
 	}
 }
 
 func (a *Agent) Stopped() {
-	a.isStop = true
+	a.isStop.Store(true)
 	<-a.stopped
 }
 
@@ -85,12 +180,40 @@ func (a *Agent) Node() *base.Node {
 	return a.node
 }
 
+// 本次运行的节点编号。每次创建 Agent 都会不同。
+func (a *Agent) Creation() uint32 {
+	return a.creation
+}
+
+// 返回本节点上 Goroutine 的 Pid 。
+func (a *Agent) Pid(routineId base.RoutineId) base.Pid {
+	return base.Pid{
+		Node:     a.Name(),
+		Creation: a.creation,
+		Id:       routineId,
+	}
+}
+
 // 设置本机的 GPMD 服务地址。默认为 ":2613"
 func (a *Agent) SetGPMD(host string, port uint16) {
 	a.gpmd.Host = host
 	a.gpmd.Port = port
 }
 
+// 设置连接的心跳间隔。连接空闲时每隔 interval 发送一次心跳，连续 missed 个间隔
+// 没有收到对端的任何数据时认为对端已经失效并关闭连接。 interval 为 0 时不检测。
+// 只对之后建立的连接生效。
+func (a *Agent) SetNetTick(interval time.Duration, missed int) {
+	a.tickInterval = interval
+	a.tickMissed = missed
+}
+
+// 设置单条请求或者应答的最大长度，超过时发送方返回 ErrMessageTooLarge ，接收方
+// 关闭连接。只对之后建立的连接生效。
+func (a *Agent) SetMaxMessageSize(size uint64) {
+	a.maxMessageSize = size
+}
+
 // 向 agent 注册一个 Goroutine 。如果该 Goroutine 对象已经被设置过 Id ，则会抛出
 // panic 。
 func (agent *Agent) RegisterRoutine(routine *base.Routine) {
@@ -98,22 +221,21 @@ func (agent *Agent) RegisterRoutine(routine *base.Routine) {
 	agent.registerRoutine(routine)
 }
 
-func (agent *Agent) Stop() {
+// 停止监听并从本地 GPMD 注销。
+func (agent *Agent) Stop() error {
+	// 先标记停止，避免 Serve 在监听关闭后重新监听。
+	agent.isStop.Store(true)
 	agent.listener.Close()
-	agent.Unregister()
+	return agent.Unregister()
 }
 
-func (agent *Agent) Unregister() {
-	resolvedAddr, rErr := net.ResolveTCPAddr("tcp", agent.gpmd.Address())
-	if rErr != nil {
-		log.Printf("godist: GPMD address error: %s", rErr)
-		return
-	}
-	conn, dErr := net.DialTCP("tcp", nil, resolvedAddr)
-	if dErr != nil {
-		log.Printf("godist: GPMD dial error: %s", dErr)
-		return
+// 从本地 GPMD 注销节点信息。
+func (agent *Agent) Unregister() error {
+	conn, err := agent.dialGPMD(agent.gpmd.Address())
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 	requestBuf := new(bytes.Buffer)
 	binpacker.NewPacker(endian, requestBuf).
 		PushByte(gpmd.REQ_UNREGISTER).
@@ -121,26 +243,33 @@ func (agent *Agent) Unregister() {
 		PushString(agent.Name())
 	request := binpacker.AddUint16Perfix(requestBuf.Bytes())
 	if _, wErr := conn.Write(request); wErr != nil {
-		log.Printf("godist: Send unregister message error: %s", wErr)
+		return fmt.Errorf("%w: %v", ErrGPMDUnreachable, wErr)
 	}
 	var apiCode, resCode byte
 	unpacker := binpacker.NewUnpacker(endian, conn)
 	unpacker.FetchByte(&apiCode).FetchByte(&resCode)
-	if unpacker.Error() != nil || apiCode != gpmd.REQ_UNREGISTER || resCode != gpmd.ACK_RES_OK {
-		log.Printf("godist: unregister node %s@%s error", agent.Name(), agent.Host())
+	if unpacker.Error() != nil {
+		return fmt.Errorf("%w: %v", ErrGPMDUnreachable, unpacker.Error())
+	}
+	if apiCode != gpmd.REQ_UNREGISTER {
+		return ErrBadAnswer
+	}
+	if resCode == gpmd.ACK_RES_NODE_NOT_EXIST {
+		return ErrNodeUnknown
+	}
+	if resCode != gpmd.ACK_RES_OK {
+		return ErrBadAnswer
 	}
+	return nil
 }
 
-// 向本地 GPMD 注册节点信息，无法注册会 panic 异常。
-func (agent *Agent) Register() {
-	resolvedAddr, rErr := net.ResolveTCPAddr("tcp", agent.gpmd.Address())
-	if rErr != nil {
-		log.Panicf("godist: GPMD address error: %s", rErr)
-	}
-	conn, dErr := net.DialTCP("tcp", nil, resolvedAddr)
-	if dErr != nil {
-		log.Panicf("godist: GPMD dial error: %s", dErr)
+// 向本地 GPMD 注册节点信息。同名节点已经注册时返回 ErrRegisterConflict 。
+func (agent *Agent) Register() error {
+	conn, err := agent.dialGPMD(agent.gpmd.Address())
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 	requestBuf := new(bytes.Buffer)
 	binpacker.NewPacker(endian, requestBuf).
 		PushByte(gpmd.REQ_REGISTER).
@@ -151,200 +280,459 @@ func (agent *Agent) Register() {
 		PushString(agent.Host())
 	request := binpacker.AddUint16Perfix(requestBuf.Bytes())
 	if _, wErr := conn.Write(request); wErr != nil {
-		log.Panicf("godist: Send register message error: %s", wErr)
+		return fmt.Errorf("%w: %v", ErrGPMDUnreachable, wErr)
 	}
 	unpacker := binpacker.NewUnpacker(endian, conn)
 	var apiCode, resCode byte
 	unpacker.FetchByte(&apiCode).FetchByte(&resCode)
-	if unpacker.Error() != nil || apiCode != gpmd.REQ_REGISTER || resCode != gpmd.ACK_RES_OK {
-		log.Panicf("godist: Register failed. API: %d, Res: %d", apiCode, resCode)
+	if unpacker.Error() != nil {
+		return fmt.Errorf("%w: %v", ErrGPMDUnreachable, unpacker.Error())
+	}
+	if apiCode != gpmd.REQ_REGISTER {
+		return ErrBadAnswer
+	}
+	if resCode == gpmd.ACK_RES_NODE_EXIST {
+		return ErrRegisterConflict
+	}
+	if resCode != gpmd.ACK_RES_OK {
+		return ErrBadAnswer
 	}
-	log.Printf("godist.agent Register to %s successful", resolvedAddr)
+	log.Printf("godist.agent Register to %s successful", conn.RemoteAddr())
+	return nil
 }
 
-func (agent *Agent) QueryAllNode(nodeName string) {
+// 连接 GPMD 。失败时返回包装了 ErrGPMDUnreachable 的错误。
+func (agent *Agent) dialGPMD(address string) (*net.TCPConn, error) {
+	resolvedAddr, rErr := net.ResolveTCPAddr("tcp", address)
+	if rErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrGPMDUnreachable, rErr)
+	}
+	conn, dErr := net.DialTCP("tcp", nil, resolvedAddr)
+	if dErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrGPMDUnreachable, dErr)
+	}
+	return conn, nil
+}
+
+// 向已连接的节点查询它所知道的全部节点，并连接其中尚未连接的节点。
+func (agent *Agent) QueryAllNode(nodeName string) error {
 	name, _ := parseNameAndHost(nodeName)
 	if name == agent.Name() {
-		return
+		return nil
 	}
-	if conn, exist := agent.findConn(name); exist {
-		requestBuf := new(bytes.Buffer)
-		binpacker.NewPacker(endian, requestBuf).
-			PushByte(REQ_QUERY_ALL).
-			PushUint16(uint16(len(agent.Name()))).
-			PushString(agent.Name())
-		request := binpacker.AddUint64Perfix(requestBuf.Bytes())
-		if _, err := conn.Write(request); err != nil {
-			return
-		}
-		// ANSWER
-		unpacker := binpacker.NewUnpacker(endian, conn)
-		var ackCode byte
-		unpacker.FetchByte(&ackCode)
-		if unpacker.Error() != nil || ackCode != ACK_QUERY_ALL_OK {
-			return
+	conn, exist := agent.findConn(name)
+	if !exist {
+		return ErrNotConnected
+	}
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint16(uint16(len(agent.Name()))).
+		PushString(agent.Name())
+	answer, err := conn.request(REQ_QUERY_ALL, requestBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	// ANSWER
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(answer))
+	var ackCode byte
+	unpacker.FetchByte(&ackCode)
+	if unpacker.Error() != nil {
+		return ErrBadAnswer
+	}
+	if ackCode == ACK_QUERY_ALL_ERR {
+		// 对端不认识本节点。
+		return ErrNodeUnknown
+	}
+	if ackCode != ACK_QUERY_ALL_OK {
+		return ErrBadAnswer
+	}
+	count, err := unpacker.ShiftUint16()
+	if err != nil {
+		return ErrBadAnswer
+	}
+	for i := 0; i < int(count); i++ {
+		var port uint16
+		var name, host string
+		unpacker.FetchUint16(&port).
+			StringWithUint16Prefix(&name).
+			StringWithUint16Prefix(&host)
+		if unpacker.Error() != nil {
+			return ErrBadAnswer
 		}
-		count, err := unpacker.ShiftUint16()
-		if err != nil {
-			return
+		node := &base.Node{
+			Port: port,
+			Host: host,
+			Name: name,
 		}
-		for i := 0; i < int(count); i++ {
-			var port uint16
-			var name, host string
-			unpacker.FetchUint16(&port).
-				StringWithUint16Prefix(&name).
-				StringWithUint16Prefix(&host)
-			if unpacker.Error() != nil {
-				return
-			}
-			node := &base.Node{
-				Port: port,
-				Host: host,
-				Name: name,
-			}
-			agent.registerNode(node)
-			if !agent.connExist(name) {
-				go func() {
-					agent.ConnectTo(node.FullName())
-				}()
-			}
+		agent.registerNode(node)
+		if !agent.connExist(name) {
+			go func() {
+				if err := agent.ConnectTo(node.FullName()); err != nil {
+					log.Printf("godist.agent connect to %s error: %s", node.Name, err)
+				}
+			}()
 		}
 	}
+	return nil
 }
 
 // 向目标节点的 GPMD 查询节点的端口号等详细信息。
 //  `nodeName` e.g. "player_01@player.1.example.local"
-func (agent *Agent) QueryNode(nodeName string) {
+func (agent *Agent) QueryNode(nodeName string) error {
+	name, _ := parseNameAndHost(nodeName)
+	if name == agent.Name() || agent.nodeExist(name) {
+		return nil
+	}
+	return agent.queryNode(nodeName)
+}
+
+// 向目标节点的 GPMD 查询并更新节点信息。节点重启之后端口可能变化。
+func (agent *Agent) queryNode(nodeName string) error {
 	name, host := parseNameAndHost(nodeName)
-	if name == agent.Name() {
-		return
-	}
-	if !agent.nodeExist(name) {
-		gpmdAddr, rErr := net.ResolveTCPAddr("tcp", fmt.Sprintf(
-			"%s:%d", host, agent.gpmd.Port,
-		))
-		if rErr != nil {
-			return
-		}
-		conn, dErr := net.DialTCP("tcp", nil, gpmdAddr)
-		defer conn.Close()
-		if dErr != nil {
-			return
-		}
-		requestBuf := new(bytes.Buffer)
-		binpacker.NewPacker(endian, requestBuf).
-			PushByte(gpmd.REQ_QUERY).
-			PushUint16(uint16(len(name))).
-			PushString(name)
-		request := binpacker.AddUint16Perfix(requestBuf.Bytes())
-		if _, wErr := conn.Write(request); wErr != nil {
-			return
-		}
-		unpacker := binpacker.NewUnpacker(endian, conn)
-		var ackCode, resCode byte
-		if unpacker.FetchByte(&ackCode).FetchByte(&resCode).Error() != nil {
-			return
-		}
-		if ackCode != gpmd.REQ_QUERY || resCode != gpmd.ACK_RES_OK {
-			return
-		}
-		var port uint16
-		var ackName string
-		if unpacker.FetchUint16(&port).StringWithUint16Prefix(&ackName).Error() != nil {
-			return
-		}
-		if ackName != name {
-			return
-		}
-		agent.registerNode(&base.Node{
-			Port: port,
-			Host: host,
-			Name: name,
-		})
+	conn, err := agent.dialGPMD(fmt.Sprintf("%s:%d", host, agent.gpmd.Port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushByte(gpmd.REQ_QUERY).
+		PushUint16(uint16(len(name))).
+		PushString(name)
+	request := binpacker.AddUint16Perfix(requestBuf.Bytes())
+	if _, wErr := conn.Write(request); wErr != nil {
+		return fmt.Errorf("%w: %v", ErrGPMDUnreachable, wErr)
+	}
+	unpacker := binpacker.NewUnpacker(endian, conn)
+	var ackCode, resCode byte
+	if err := unpacker.FetchByte(&ackCode).FetchByte(&resCode).Error(); err != nil {
+		return fmt.Errorf("%w: %v", ErrGPMDUnreachable, err)
+	}
+	if ackCode != gpmd.REQ_QUERY {
+		return ErrBadAnswer
+	}
+	if resCode == gpmd.ACK_RES_NODE_NOT_EXIST {
+		return ErrNodeUnknown
+	}
+	if resCode != gpmd.ACK_RES_OK {
+		return ErrBadAnswer
+	}
+	var port uint16
+	var ackName string
+	if unpacker.FetchUint16(&port).StringWithUint16Prefix(&ackName).Error() != nil {
+		return ErrBadAnswer
+	}
+	if ackName != name {
+		return ErrBadAnswer
 	}
+	agent.registerNode(&base.Node{
+		Port: port,
+		Host: host,
+		Name: name,
+	})
+	return nil
 }
 
 // XXX: 权衡参数传入格式是否需要是节点全名(xx@xx)还是节点名(xx)即可。
 //
 // 尝试向目标节点建立连接。该节点名称必须在 `agent.nodes` 中有注册的信息。建立好
 // 之后会一直保持持有连接。用于向目标节点的 Goroutine 消息发送。
-//  `nodeName` e.g. "player_01@player.1.example.local"
-func (agent *Agent) ConnectTo(nodeName string) {
-	agent.connectTo(nodeName, false)
+//
+//	`nodeName` e.g. "player_01@player.1.example.local"
+func (agent *Agent) ConnectTo(nodeName string) error {
+	return agent.connectTo(nodeName, false)
 }
 
-func (agent *Agent) connectTo(nodeName string, isReturn bool) {
+// 与节点之间只保留一条连接，双方共用。已经持有连接或者正在连接时直接返回；
+// 对端已经持有或者正在建立到本节点的连接时，对端应答 ACK_CONN_NODE_EXIST ，最多
+// 等待 PEER_CONNECT_TIMEOUT 直到对端的连接登记，超时返回 ErrNodeUnreachable 。
+// isReturn 只用于应答不支持 CAP_SINGLE_CONN 的节点的反向连接。
+func (agent *Agent) connectTo(nodeName string, isReturn bool) error {
 	name, _ := parseNameAndHost(nodeName)
 	if name == agent.Name() {
-		return
+		return nil
 	}
-	if node, exist := agent.findNode(name); exist {
-		address, rErr := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", node.Host, node.Port))
-		if rErr != nil {
-			// handle error
-			return
-		}
-		conn, dErr := net.DialTCP("tcp", nil, address)
-		if dErr != nil {
-			// handle error
-			log.Printf("godist.agent connect to %s[%s] error: %s", name, address, dErr)
-			return
-		}
-		requestBuf := new(bytes.Buffer)
-		pk := binpacker.NewPacker(endian, requestBuf).PushByte(REQ_CONN)
-		if isReturn {
-			pk.PushByte(ACK_CONN_IS_RETURN)
-		} else {
-			pk.PushByte(ACK_CONN_IS_NOT_RETURN)
-		}
-		pk.PushUint16(agent.Port()).
-			PushUint16(uint16(len(agent.Name()))).
-			PushString(agent.Name()).
-			PushUint16(uint16(len(agent.Host()))).
-			PushString(agent.Host())
-		request := binpacker.AddUint64Perfix(requestBuf.Bytes())
-		if _, wErr := conn.Write(request); wErr != nil {
-			// handle error
-			conn.Close()
-			return
+	node, exist := agent.findNode(name)
+	if !exist {
+		return ErrNodeUnknown
+	}
+	if !agent.startDialing(name) {
+		return nil
+	}
+	defer agent.stopDialing(name)
+	address, rErr := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", node.Host, node.Port))
+	if rErr != nil {
+		return fmt.Errorf("%w: %v", ErrNodeUnreachable, rErr)
+	}
+	tcpConn, dErr := net.DialTCP("tcp", nil, address)
+	if dErr != nil {
+		log.Printf("godist.agent connect to %s[%s] error: %s", name, address, dErr)
+		return fmt.Errorf("%w: %v", ErrNodeUnreachable, dErr)
+	}
+	netConn, err := agent.secureClient(tcpConn, name)
+	if err != nil {
+		return err
+	}
+	conn := newConnection(agent, netConn)
+	conn.name = name
+	conn.outbound = true
+	if agent.cookie == nil {
+		// 对端的证书已经在 TLS 握手时校验过了，设置了 cookie 时由 challenge 校验。
+		atomic.StoreInt32(&conn.authenticated, 1)
+	}
+	conn.start()
+	digest, err := agent.challenge(conn, name)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	requestBuf := new(bytes.Buffer)
+	pk := binpacker.NewPacker(endian, requestBuf)
+	if isReturn {
+		pk.PushByte(ACK_CONN_IS_RETURN)
+	} else {
+		pk.PushByte(ACK_CONN_IS_NOT_RETURN)
+	}
+	pk.PushUint16(agent.Port()).
+		PushUint16(uint16(len(agent.Name()))).
+		PushString(agent.Name()).
+		PushUint16(uint16(len(agent.Host()))).
+		PushString(agent.Host()).
+		PushByte(byte(len(agent.compressors)))
+	for _, compressor := range agent.compressors {
+		pk.PushByte(compressor.Id())
+	}
+	pk.PushByte(byte(len(digest))).
+		PushBytes(digest).
+		PushUint16(PROTOCOL_VERSION).
+		PushUint64(agent.capabilities).
+		PushUint32(agent.creation)
+	// TODO set connect timeout
+	answer, err := conn.request(REQ_CONN, requestBuf.Bytes())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if len(answer) > 0 && answer[0] == ACK_CONN_AUTH_FAILED {
+		log.Printf("godist.agent node %s refused connection", name)
+		conn.Close()
+		return ErrAuthFailed
+	}
+	if len(answer) > 0 && answer[0] == ACK_CONN_NODE_EXIST {
+		log.Printf("godist.agent node %s already holds a connection", name)
+		conn.Close()
+		if !agent.waitConn(name, PEER_CONNECT_TIMEOUT) {
+			return fmt.Errorf("%w: %s refused the connection but did not connect", ErrNodeUnreachable, name)
 		}
-		unpacker := binpacker.NewUnpacker(endian, conn)
-		// TODO set connect timeout
-		ackCode, err := unpacker.ShiftByte()
-		if err != nil || ackCode != ACK_CONN_OK {
+		return nil
+	}
+	if len(answer) == 0 || answer[0] != ACK_CONN_OK {
+		conn.Close()
+		return ErrBadAnswer
+	}
+	if len(answer) >= 12 {
+		conn.negotiate(endian.Uint16(answer[2:4]), endian.Uint64(answer[4:12]))
+	} else {
+		conn.negotiate(0, LEGACY_CAPABILITIES)
+	}
+	if len(answer) >= 16 {
+		conn.setPeerCreation(endian.Uint32(answer[12:16]))
+	}
+	// 对端没有选定 Compressor 时不压缩。
+	if len(answer) > 1 && answer[1] != COMPRESS_NONE {
+		compressor, exist := agent.findCompressor(answer[1])
+		if !exist {
 			conn.Close()
-			return
+			return ErrBadAnswer
 		}
-		agent.registerConn(name, conn)
+		conn.setCompressor(compressor)
 	}
+	agent.registerConn(name, conn)
+	return nil
 }
 
 // 向目标 Goroutine 发送消息。该目标节点连接必须事先注册在 `agent.connections`
-// 中。
-func (agent *Agent) CastTo(nodeName string, routineId base.RoutineId, message []byte) {
+// 中，或者正在按照 ReconnectPolicy 重连。
+func (agent *Agent) CastTo(nodeName string, routineId base.RoutineId, message []byte) error {
 	if nodeName == agent.Name() {
-		if routine, exist := agent.findRoutine(routineId); exist {
-			routine.Cast(message)
+		routine, exist := agent.findRoutine(routineId)
+		if !exist {
+			return ErrRoutineNotFound
 		}
-		return
+		return deliverError(routine.Deliver(message), ErrRoutineNotFound)
 	}
-	if conn, exist := agent.findConn(nodeName); exist {
+	headerBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, headerBuf).PushUint64(uint64(routineId))
+	request, _ := packMessage(headerBuf.Bytes(), CODEC_NONE, message)
+	answer, queued, err := agent.castRequest(nodeName, REQ_CAST, request, nil)
+	if err != nil || queued {
+		return err
+	}
+	if len(answer) == 0 {
+		return ErrBadAnswer
+	}
+	switch answer[0] {
+	case ACK_CAST_OK:
+		return nil
+	case ACK_CAST_ROUTINE_NOT_FOUND:
+		return ErrRoutineNotFound
+	case ACK_CAST_MAILBOX_FULL:
+		return ErrMailboxFull
+	default:
+		return ErrBadAnswer
+	}
+}
+
+// 向 Pid 指向的 Goroutine 发送消息。本节点的 Pid 直接投递，其他节点的 Pid 通过
+// 连接发送。 Pid 属于目标节点之前的运行实例时返回 ErrStalePid 。
+func (agent *Agent) Send(pid base.Pid, message []byte) error {
+	return agent.sendEncoded(pid, CODEC_NONE, message)
+}
+
+// 发送由 codec 编码的消息， codec 为 CODEC_NONE 时与 Send 相同。
+func (agent *Agent) sendEncoded(pid base.Pid, codec byte, data []byte) error {
+	if pid.Node == agent.Name() {
+		if pid.Creation != agent.creation {
+			return ErrStalePid
+		}
+		routine, exist := agent.findRoutine(pid.Id)
+		if !exist {
+			return ErrRoutineNotFound
+		}
+		return deliverError(routine.DeliverEncoded(codec, data), ErrRoutineNotFound)
+	}
+	headerBuf := new(bytes.Buffer)
+	pushPid(binpacker.NewPacker(endian, headerBuf), pid)
+	request, legacy := packMessage(headerBuf.Bytes(), codec, data)
+	answer, queued, err := agent.castRequest(pid.Node, REQ_SEND, request, legacy)
+	if err != nil || queued {
+		return err
+	}
+	if len(answer) == 0 {
+		return ErrBadAnswer
+	}
+	switch answer[0] {
+	case ACK_CAST_OK:
+		return nil
+	case ACK_CAST_ROUTINE_NOT_FOUND:
+		return ErrRoutineNotFound
+	case ACK_SEND_STALE_PID:
+		return ErrStalePid
+	case ACK_CAST_MAILBOX_FULL:
+		return ErrMailboxFull
+	default:
+		return ErrBadAnswer
+	}
+}
+
+// 向目标 Goroutine 发送请求并等待其回复。目标 Routine 需要设置 Requests 通道，
+// 并对收到的 base.Request 调用 Reply 。等待时间由 `ctx` 控制。
+func (agent *Agent) CallTo(ctx context.Context, nodeName string, routineId base.RoutineId, message []byte) ([]byte, error) {
+	callId, replyChan := agent.newCall()
+	defer agent.removeCall(callId)
+	if nodeName == agent.Name() {
+		routine, exist := agent.findRoutine(routineId)
+		if !exist {
+			return nil, ErrRoutineNotFound
+		}
+		request := base.NewRequest(message, func(reply []byte) error {
+			if !agent.deliverReply(callId, reply) {
+				return ErrCallExpired
+			}
+			return nil
+		})
+		if !routine.Call(request) {
+			return nil, ErrCallRejected
+		}
+	} else {
+		conn, exist := agent.findConn(nodeName)
+		if !exist {
+			return nil, ErrNotConnected
+		}
 		requestBuf := new(bytes.Buffer)
 		binpacker.NewPacker(endian, requestBuf).
-			PushByte(REQ_CAST).
+			PushUint64(callId).
 			PushUint64(uint64(routineId)).
 			PushUint64(uint64(len(message))).
 			PushBytes(message)
-		request := binpacker.AddUint64Perfix(requestBuf.Bytes())
-		if _, wErr := conn.Write(request); wErr != nil {
-			return
+		answer, err := conn.requestContext(ctx, REQ_CALL, requestBuf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if len(answer) == 0 {
+			return nil, ErrBadAnswer
 		}
-		unpacker := binpacker.NewUnpacker(endian, conn)
-		ackCode, err := unpacker.ShiftByte()
-		if err != nil || ackCode != ACK_CAST_OK {
-			return
+		switch answer[0] {
+		case ACK_CALL_OK:
+		case ACK_CAST_ROUTINE_NOT_FOUND:
+			return nil, ErrRoutineNotFound
+		case ACK_CALL_REJECTED:
+			return nil, ErrCallRejected
+		default:
+			return nil, ErrBadAnswer
 		}
 	}
+	select {
+	case reply := <-replyChan:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 通过 Call 请求到达的连接将结果发回调用方。 ctx 结束时不再等待对端确认。
+func (agent *Agent) replyTo(ctx context.Context, conn *connection, callId uint64, message []byte) error {
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint64(callId).
+		PushUint64(uint64(len(message))).
+		PushBytes(message)
+	answer, err := conn.requestContext(ctx, REQ_REPLY, requestBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(answer) == 0 {
+		return ErrBadAnswer
+	}
+	switch answer[0] {
+	case ACK_REPLY_OK:
+		return nil
+	case ACK_REPLY_CALL_NOT_FOUND:
+		return ErrCallExpired
+	default:
+		return ErrBadAnswer
+	}
+}
+
+func (agent *Agent) newCall() (uint64, chan []byte) {
+	agent.callLock.Lock()
+	defer agent.callLock.Unlock()
+	callId := atomic.AddUint64(&agent.callCounter, 1)
+	replyChan := make(chan []byte, 1)
+	agent.calls[callId] = replyChan
+	return callId, replyChan
+}
+
+func (agent *Agent) removeCall(callId uint64) {
+	agent.callLock.Lock()
+	defer agent.callLock.Unlock()
+	delete(agent.calls, callId)
+}
+
+// 将回复交给等待中的调用方。调用方已经超时返回时，回复会被丢弃。
+func (agent *Agent) deliverReply(callId uint64, message []byte) bool {
+	agent.callLock.Lock()
+	defer agent.callLock.Unlock()
+	replyChan, exist := agent.calls[callId]
+	if !exist {
+		return false
+	}
+	select {
+	case replyChan <- message:
+		return true
+	default:
+		return false
+	}
 }
 
 func (agent *Agent) registerRoutine(routine *base.Routine) {
@@ -355,6 +743,12 @@ func (agent *Agent) registerRoutine(routine *base.Routine) {
 	}
 }
 
+func (agent *Agent) unregisterRoutine(routineId base.RoutineId) {
+	agent.routineLock.Lock()
+	defer agent.routineLock.Unlock()
+	delete(agent.routines, routineId)
+}
+
 func (agent *Agent) findRoutine(routineId base.RoutineId) (*base.Routine, bool) {
 	agent.routineLock.RLock()
 	defer agent.routineLock.RUnlock()
@@ -362,19 +756,176 @@ func (agent *Agent) findRoutine(routineId base.RoutineId) (*base.Routine, bool)
 	return routine, exist
 }
 
-func (agent *Agent) registerConn(name string, conn *net.TCPConn) {
+func (agent *Agent) registerConn(name string, conn *connection) {
+	agent.connectionLock.Lock()
+	oldConn, exist := agent.connections[name]
+	agent.connections[name] = conn
+	agent.connectionLock.Unlock()
+	restarted := exist && restartedPeer(oldConn, conn)
+	if restarted {
+		agent.nodeRestarted(name)
+	}
+	agent.connUp(name, conn, oldConn, exist, restarted)
+}
+
+// 对端接入的连接，与本节点发起的连接冲突时按照节点名决定保留哪一条：双方同时
+// 连接时保留节点名较小的一方发起的连接。对端重启之后的连接总是替换旧的连接。
+// 返回 false 时拒绝该连接。
+func (agent *Agent) acceptConn(name string, conn *connection) bool {
 	agent.connectionLock.Lock()
-	defer agent.connectionLock.Unlock()
 	oldConn, exist := agent.connections[name]
+	restarted := exist && restartedPeer(oldConn, conn)
+	if !restarted && (agent.dialing[name] || exist && oldConn.outbound) && agent.Name() < name {
+		agent.connectionLock.Unlock()
+		return false
+	}
+	agent.connections[name] = conn
+	agent.connectionLock.Unlock()
+	if restarted {
+		// 在应答之前清理，之后读到的都是对端新的运行实例的请求。
+		agent.nodeRestarted(name)
+	}
+	// 同步集群状态需要在这条连接上发送请求，不能阻塞其读协程。
+	go agent.connUp(name, conn, oldConn, exist, restarted)
+	return true
+}
+
+// 新的连接是否来自对端重启之后的运行实例。
+func restartedPeer(oldConn, conn *connection) bool {
+	oldCreation := oldConn.getPeerCreation()
+	return oldCreation != 0 && oldCreation != conn.getPeerCreation()
+}
+
+// 对端重启之后，旧的连接被新的连接替换， unregisterConn 不会处理旧的连接，由这里
+// 清理对端之前的运行实例的状态并发布 NODE_DOWN 。
+func (agent *Agent) nodeRestarted(name string) {
+	log.Printf("godist: Node %s restarted", name)
+	agent.nodeDown(name)
+	agent.publishNodeEvent(NodeEvent{
+		Kind:   NODE_DOWN,
+		Node:   name,
+		Reason: NODE_DOWN_RESTARTED,
+	})
+}
+
+// 登记连接之后调用，关闭被替换的旧连接并同步集群状态。
+func (agent *Agent) connUp(name string, conn, oldConn *connection, exist, restarted bool) {
 	if exist {
 		log.Printf("godist: Close the old connection of node %s", name)
 		oldConn.Close()
 	}
-	agent.connections[name] = conn
 	log.Printf("godist: Hoding node %s connection", name)
+	agent.nodeUp(conn)
+	if !exist || restarted {
+		agent.publishNodeEvent(NodeEvent{Kind: NODE_UP, Node: name})
+	}
+}
+
+// 等待到节点 name 的连接登记，超过 timeout 时返回 false 。
+func (agent *Agent) waitConn(name string, timeout time.Duration) bool {
+	events, cancel := agent.SubscribeNodeEvents()
+	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !agent.connExist(name) {
+		select {
+		case <-events:
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
+
+// 标记正在连接节点 name 。已经持有连接或者正在连接时返回 false 。
+func (agent *Agent) startDialing(name string) bool {
+	agent.connectionLock.Lock()
+	defer agent.connectionLock.Unlock()
+	if _, exist := agent.connections[name]; exist || agent.dialing[name] {
+		return false
+	}
+	agent.dialing[name] = true
+	return true
+}
+
+func (agent *Agent) stopDialing(name string) {
+	agent.connectionLock.Lock()
+	delete(agent.dialing, name)
+	agent.connectionLock.Unlock()
+}
+
+// 连接关闭时从 `agent.connections` 中移除。已经被新连接替换的不做处理。
+func (agent *Agent) unregisterConn(conn *connection) {
+	agent.connectionLock.Lock()
+	current, exist := agent.connections[conn.name]
+	released := exist && current == conn
+	if released {
+		delete(agent.connections, conn.name)
+	}
+	agent.connectionLock.Unlock()
+	if released {
+		log.Printf("godist: Release node %s connection for reason: %s", conn.name, conn.closeReason)
+		agent.nodeDown(conn.name)
+		agent.publishNodeEvent(NodeEvent{
+			Kind:   NODE_DOWN,
+			Node:   conn.name,
+			Reason: conn.closeReason,
+		})
+		if !agent.isStop.Load() {
+			agent.startReconnect(conn.name)
+		}
+	}
+}
+
+// 持有到节点的连接之后调用，同步集群状态。
+func (agent *Agent) nodeUp(conn *connection) {
+	if conn.supports(CAP_GLOBAL) {
+		agent.syncGlobals(conn)
+	}
+	if conn.supports(CAP_PG) {
+		agent.syncGroups(conn)
+	}
 }
 
-func (agent *Agent) findConn(name string) (conn *net.TCPConn, exist bool) {
+// 到节点的连接断开之后调用，清理该节点相关的状态。
+func (agent *Agent) nodeDown(name string) {
+	agent.releaseGlobals(name)
+	agent.releaseGroups(name)
+	agent.releaseMonitors(name)
+}
+
+// Goroutine 退出之后调用，释放它持有的名字、组成员身份和定时器，再以 reason 通知监视者和
+// 链接方。先释放名字，监视者收到 Down 之后可以立即用同样的名字重启。
+func (agent *Agent) routineExited(routineId base.RoutineId, reason string) {
+	agent.releaseName(routineId)
+	agent.leaveGroups(agent.Pid(routineId))
+	agent.cancelTimers(routineId)
+	agent.exitMonitors(routineId, reason)
+}
+
+// 将投递结果转换为错误。 Goroutine 已经退出时返回 notFound 。
+func deliverError(result base.DeliverResult, notFound error) error {
+	switch result {
+	case base.DELIVER_FULL:
+		return ErrMailboxFull
+	case base.DELIVER_CLOSED:
+		return notFound
+	}
+	return nil
+}
+
+// 当前持有连接的所有节点的连接。
+func (agent *Agent) allConns() []*connection {
+	agent.connectionLock.RLock()
+	defer agent.connectionLock.RUnlock()
+	conns := make([]*connection, 0, len(agent.connections))
+	for _, conn := range agent.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (agent *Agent) findConn(name string) (conn *connection, exist bool) {
 	agent.connectionLock.RLock()
 	defer agent.connectionLock.RUnlock()
 	conn, exist = agent.connections[name]
@@ -392,9 +943,9 @@ func (agent *Agent) registerNode(node *base.Node) {
 	agent.nodeLock.Lock()
 	defer agent.nodeLock.Unlock()
 	if _, exist := agent.nodes[node.Name]; !exist {
-		agent.nodes[node.Name] = node
 		log.Printf("godist: Node %s register...", node.Name)
 	}
+	agent.nodes[node.Name] = node
 }
 
 func (agent *Agent) findNode(name string) (node *base.Node, exist bool) {
@@ -416,6 +967,51 @@ func (agent *Agent) incrRoutineId() base.RoutineId {
 	return base.RoutineId(id)
 }
 
+// 生成节点编号。不为 0 ，保证零值 Pid 不会指向任何 Goroutine 。
+func newCreation() uint32 {
+	for {
+		if creation := uint32(time.Now().UnixNano()); creation != 0 {
+			return creation
+		}
+	}
+}
+
+// 以 | pid length | pid | 的格式写入 Pid 。
+func pushPid(pk *binpacker.Packer, pid base.Pid) *binpacker.Packer {
+	pidBytes, _ := pid.MarshalBinary()
+	return pk.PushUint16(uint16(len(pidBytes))).PushBytes(pidBytes)
+}
+
+// 以 | header | message length | message | codec | 的格式写入消息， codec 为
+// CODEC_NONE 时省略。不支持 CAP_CODEC 的节点按照旧的格式处理，把 codec 写在
+// message 的开头，即 legacy 。没有 codec 时两种格式相同， legacy 为 nil 。
+func packMessage(header []byte, codec byte, data []byte) (request, legacy []byte) {
+	if codec == CODEC_NONE {
+		return packBytes(header, data), nil
+	}
+	request = append(packBytes(header, data), codec)
+	legacy = packBytes(header, append([]byte{codec}, data...))
+	return request, legacy
+}
+
+func packBytes(header, message []byte) []byte {
+	requestBuf := new(bytes.Buffer)
+	requestBuf.Write(header)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint64(uint64(len(message))).
+		PushBytes(message)
+	return requestBuf.Bytes()
+}
+
+// 读取 pushPid 写入的 Pid 。
+func fetchPid(unpacker *binpacker.Unpacker, pid *base.Pid) error {
+	var pidBytes []byte
+	if err := unpacker.BytesWithUint16Prefix(&pidBytes).Error(); err != nil {
+		return err
+	}
+	return pid.UnmarshalBinary(pidBytes)
+}
+
 func parseNameAndHost(nodeName string) (string, string) {
 	if !strings.Contains(nodeName, "@") {
 		return nodeName, ""
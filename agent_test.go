@@ -2,6 +2,8 @@ package godist
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"godist/base"
 	"godist/gpmd"
@@ -9,6 +11,7 @@ import (
 	"log"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/smartystreets/goconvey/convey"
 	"github.com/zhuangsirui/binpacker"
@@ -32,22 +35,22 @@ func TestAgent(t *testing.T) {
 		convey.Convey("Error host", func() {
 			agent := New("xx@x8x8x*(&)")
 			agent.SetGPMD("fake**xx", 1000)
-			convey.So(func() {
-				agent.Register()
-			}, convey.ShouldPanic)
-			convey.So(func() {
-				agent.Listen()
-			}, convey.ShouldPanic)
+			convey.So(errors.Is(agent.Register(), ErrGPMDUnreachable), convey.ShouldBeTrue)
+			convey.So(errors.Is(agent.Listen(), ErrListenFailed), convey.ShouldBeTrue)
 		})
 
 		convey.Convey("Without GPMD", func() {
 			agent := New("agent@localhost")
 			convey.So(agent.Host(), convey.ShouldEqual, agent.Host())
 			convey.So(agent.Name(), convey.ShouldEqual, agent.Name())
+			convey.So(agent.Creation(), convey.ShouldNotEqual, New("agent@localhost").Creation())
+			convey.So(agent.Send(base.Pid{Node: "nobody"}, nil), convey.ShouldEqual, ErrNotConnected)
 			agent.SetGPMD("localhost", 1000)
-			convey.So(func() {
-				agent.Register()
-			}, convey.ShouldPanic)
+			convey.So(errors.Is(agent.Register(), ErrGPMDUnreachable), convey.ShouldBeTrue)
+			convey.So(agent.QueryAllNode("nobody@localhost"), convey.ShouldEqual, ErrNotConnected)
+			convey.So(agent.ConnectTo("nobody@localhost"), convey.ShouldEqual, ErrNodeUnknown)
+			convey.So(agent.CastTo("nobody", base.RoutineId(9898), nil), convey.ShouldEqual, ErrNotConnected)
+			convey.So(agent.CastTo(agent.Name(), base.RoutineId(9898), nil), convey.ShouldEqual, ErrRoutineNotFound)
 		})
 
 		convey.Convey("With GPMD", func() {
@@ -61,14 +64,22 @@ func TestAgent(t *testing.T) {
 				convey.So(agent.Host(), convey.ShouldEqual, agent.Host())
 				convey.So(agent.Name(), convey.ShouldEqual, agent.Name())
 				agent.SetGPMD("localhost", gpmdPort)
-				convey.So(func() {
-					agent.Listen()
-					agent.Register()
-				}, convey.ShouldNotPanic)
+				convey.So(agent.Listen(), convey.ShouldBeNil)
+				convey.So(agent.Register(), convey.ShouldBeNil)
 				go agent.Serve()
 
 				convey.Convey("Query self", func() {
-					agent.QueryAllNode(agent.node.FullName())
+					convey.So(agent.QueryAllNode(agent.node.FullName()), convey.ShouldBeNil)
+				})
+
+				convey.Convey("Register conflict", func() {
+					same := New("agent@localhost")
+					same.SetGPMD("localhost", gpmdPort)
+					convey.So(same.Register(), convey.ShouldEqual, ErrRegisterConflict)
+				})
+
+				convey.Convey("Query unknown node", func() {
+					convey.So(agent.QueryNode("nobody@localhost"), convey.ShouldEqual, ErrNodeUnknown)
 				})
 
 				convey.Convey("Connect", func() {
@@ -108,9 +119,100 @@ func TestAgent(t *testing.T) {
 						}
 						ping := []byte("ping")
 						targetAgent.RegisterRoutine(routine)
-						go agent.CastTo(targetAgent.Name(), routine.GetId(), ping)
+						convey.So(agent.CastTo(targetAgent.Name(), routine.GetId(), ping), convey.ShouldBeNil)
+						convey.So(<-routine.Channel, convey.ShouldResemble, ping)
+						convey.So(agent.CastTo(targetAgent.Name(), base.RoutineId(9898), ping), convey.ShouldEqual, ErrRoutineNotFound)
+					})
+
+					convey.Convey("Send", func() {
+						routine := &base.Routine{
+							Channel: make(chan []byte, 1),
+						}
+						ping := []byte("ping")
+						targetAgent.RegisterRoutine(routine)
+						pid := targetAgent.Pid(routine.GetId())
+						convey.So(pid.Node, convey.ShouldEqual, targetAgent.Name())
+						convey.So(agent.Send(pid, ping), convey.ShouldBeNil)
+						convey.So(<-routine.Channel, convey.ShouldResemble, ping)
+						convey.So(targetAgent.Send(pid, ping), convey.ShouldBeNil)
 						convey.So(<-routine.Channel, convey.ShouldResemble, ping)
-						go agent.CastTo(targetAgent.Name(), base.RoutineId(9898), ping)
+
+						stale := pid
+						stale.Creation++
+						convey.So(agent.Send(stale, ping), convey.ShouldEqual, ErrStalePid)
+						convey.So(targetAgent.Send(stale, ping), convey.ShouldEqual, ErrStalePid)
+						missing := targetAgent.Pid(base.RoutineId(9898))
+						convey.So(agent.Send(missing, ping), convey.ShouldEqual, ErrRoutineNotFound)
+					})
+
+					convey.Convey("Concurrent cast", func() {
+						count := 50
+						routine := &base.Routine{
+							Channel: make(chan []byte, count),
+						}
+						targetAgent.RegisterRoutine(routine)
+						for i := 0; i < count; i++ {
+							go agent.CastTo(targetAgent.Name(), routine.GetId(), []byte(fmt.Sprintf("%d", i)))
+						}
+						received := make(map[string]bool)
+						for i := 0; i < count; i++ {
+							received[string(<-routine.Channel)] = true
+						}
+						convey.So(len(received), convey.ShouldEqual, count)
+					})
+
+					targetAgent.Stop()
+					targetAgent.Stopped()
+				})
+
+				convey.Convey("Call", func() {
+					targetAgent := New("call_target@localhost")
+					targetAgent.SetGPMD(agent.Host(), gpmdPort)
+					targetAgent.Listen()
+					targetAgent.Register()
+					go targetAgent.Serve()
+					agent.QueryNode(targetAgent.node.FullName())
+					agent.ConnectTo(targetAgent.Name())
+
+					convey.Convey("Call to", func() {
+						routine := &base.Routine{
+							Channel:  make(chan []byte, 1),
+							Requests: make(chan *base.Request, 1),
+						}
+						targetAgent.RegisterRoutine(routine)
+						go func() {
+							request := <-routine.Requests
+							request.Reply(append([]byte("re:"), request.Message...))
+						}()
+						ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+						defer cancel()
+						reply, err := agent.CallTo(ctx, targetAgent.Name(), routine.GetId(), []byte("ping"))
+						convey.So(err, convey.ShouldBeNil)
+						convey.So(reply, convey.ShouldResemble, []byte("re:ping"))
+
+						_, err = agent.CallTo(ctx, targetAgent.Name(), base.RoutineId(9898), []byte("ping"))
+						convey.So(err, convey.ShouldEqual, ErrRoutineNotFound)
+
+						castOnly := &base.Routine{
+							Channel: make(chan []byte, 1),
+						}
+						targetAgent.RegisterRoutine(castOnly)
+						_, err = agent.CallTo(ctx, targetAgent.Name(), castOnly.GetId(), []byte("ping"))
+						convey.So(err, convey.ShouldEqual, ErrCallRejected)
+					})
+
+					convey.Convey("Call timeout", func() {
+						routine := &base.Routine{
+							Channel:  make(chan []byte, 1),
+							Requests: make(chan *base.Request, 1),
+						}
+						targetAgent.RegisterRoutine(routine)
+						ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+						defer cancel()
+						_, err := agent.CallTo(ctx, targetAgent.Name(), routine.GetId(), []byte("ping"))
+						convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+						request := <-routine.Requests
+						convey.So(request.Reply([]byte("late")), convey.ShouldEqual, ErrCallExpired)
 					})
 
 					targetAgent.Stop()
@@ -155,20 +257,255 @@ func TestAgent(t *testing.T) {
 
 			convey.Convey("GPMD Addr error", func() {
 				agent.SetGPMD("fake**host", 0)
-				convey.So(func() {
-					agent.Unregister()
-				}, convey.ShouldNotPanic)
+				convey.So(errors.Is(agent.Unregister(), ErrGPMDUnreachable), convey.ShouldBeTrue)
+			})
+
+			convey.Convey("Unregister twice", func() {
+				convey.So(agent.Unregister(), convey.ShouldBeNil)
+				convey.So(agent.Unregister(), convey.ShouldEqual, ErrNodeUnknown)
 			})
 
 			m.Stop()
 			m.Stopped()
 
 			convey.Convey("GPMD down", func() {
-				convey.So(func() {
-					agent.Unregister()
-				}, convey.ShouldNotPanic)
+				convey.So(errors.Is(agent.Unregister(), ErrGPMDUnreachable), convey.ShouldBeTrue)
 			})
 		})
 
 	})
 }
+
+func TestSingleConnection(t *testing.T) {
+	convey.Convey("Single connection", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+
+		convey.Convey("Shared by both directions", func() {
+			agents := startAgents(gpmdPort, "single_a", "single_b")
+			a, b := agents[0], agents[1]
+			ca, _ := a.findConn(b.Name())
+			cb, _ := b.findConn(a.Name())
+			convey.So(ca.outbound, convey.ShouldBeTrue)
+			convey.So(cb.outbound, convey.ShouldBeFalse)
+			convey.So(ca.conn.LocalAddr().String(), convey.ShouldEqual, cb.conn.RemoteAddr().String())
+			convey.So(b.ConnectTo(a.Name()), convey.ShouldBeNil)
+			current, _ := b.findConn(a.Name())
+			convey.So(current, convey.ShouldEqual, cb)
+			stopAgents(agents)
+		})
+
+		convey.Convey("Restarted peer replaces the connection", func() {
+			agents := startAgents(gpmdPort, "single_a", "single_b")
+			a, b := agents[0], agents[1]
+			target := b.NewProcess()
+			convey.So(b.RegisterGlobal("restarted", target.Pid()), convey.ShouldBeNil)
+			convey.So(waitFor(func() bool {
+				_, exist := a.WhereIsGlobal("restarted")
+				return exist
+			}), convey.ShouldBeTrue)
+			watcher := a.NewProcess()
+			watcher.Monitor(target.Pid())
+			events, cancel := a.SubscribeNodeEvents()
+			defer cancel()
+
+			// 对端以新的 creation 接入，旧的连接还没有断开。
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := newConnection(a, local)
+			answer, err := a.handleConnect(conn, connectRequest(b.Name(), b.creation+1))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer[0], convey.ShouldEqual, ACK_CONN_OK)
+
+			message, err := watcher.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			down, ok := message.Signal.(base.Down)
+			convey.So(ok, convey.ShouldBeTrue)
+			convey.So(down.Pid, convey.ShouldResemble, target.Pid())
+			convey.So(down.Reason, convey.ShouldEqual, base.REASON_NOCONNECTION)
+			_, exist := a.WhereIsGlobal("restarted")
+			convey.So(exist, convey.ShouldBeFalse)
+			event := <-events
+			convey.So(event.Kind, convey.ShouldEqual, NODE_DOWN)
+			convey.So(event.Reason, convey.ShouldEqual, NODE_DOWN_RESTARTED)
+			// 对端不会应答同步请求，关闭连接之后才会发布 NODE_UP 。
+			conn.Close()
+			convey.So(waitFor(func() bool {
+				select {
+				case event := <-events:
+					return event.Kind == NODE_UP
+				default:
+					return false
+				}
+			}), convey.ShouldBeTrue)
+			stopAgents(agents)
+		})
+
+		convey.Convey("Simultaneous connect", func() {
+			agents := make([]*Agent, 2)
+			for i, name := range []string{"single_c", "single_d"} {
+				agents[i] = New(name + "@localhost")
+				agents[i].SetGPMD("localhost", gpmdPort)
+				agents[i].Listen()
+				agents[i].Register()
+				go agents[i].Serve()
+			}
+			c, d := agents[0], agents[1]
+			c.QueryNode(d.Node().FullName())
+			d.QueryNode(c.Node().FullName())
+			errs := make(chan error, 2)
+			go func() { errs <- c.ConnectTo(d.Name()) }()
+			go func() { errs <- d.ConnectTo(c.Name()) }()
+			convey.So(<-errs, convey.ShouldBeNil)
+			convey.So(<-errs, convey.ShouldBeNil)
+			// 两边的 ConnectTo 返回时都已经持有同一条连接。
+			cc, exist := c.findConn(d.Name())
+			convey.So(exist, convey.ShouldBeTrue)
+			dc, exist := d.findConn(c.Name())
+			convey.So(exist, convey.ShouldBeTrue)
+			convey.So(cc.conn.LocalAddr().String(), convey.ShouldEqual, dc.conn.RemoteAddr().String())
+			convey.So(cc.conn.RemoteAddr().String(), convey.ShouldEqual, dc.conn.LocalAddr().String())
+			stopAgents(agents)
+		})
+
+		m.Stop()
+		m.Stopped()
+	})
+
+	convey.Convey("Connection conflict", t, func() {
+		agent := New("single_a@localhost")
+		agent.isStop.Store(true)
+		local, remote := net.Pipe()
+		defer remote.Close()
+		old := newConnection(agent, local)
+		old.name = "single_b"
+		old.outbound = true
+		old.setPeerCreation(1)
+		agent.connections["single_b"] = old
+
+		convey.Convey("Refuse the loser", func() {
+			conn := newConnection(agent, nil)
+			answer, err := agent.handleConnect(conn, connectRequest("single_b", 1))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_CONN_NODE_EXIST})
+			current, _ := agent.findConn("single_b")
+			convey.So(current, convey.ShouldEqual, old)
+
+			agent.connections = make(map[string]*connection)
+			agent.dialing["single_b"] = true
+			answer, _ = agent.handleConnect(conn, connectRequest("single_b", 1))
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_CONN_NODE_EXIST})
+			convey.So(agent.connExist("single_b"), convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Replace after restart", func() {
+			newLocal, newRemote := net.Pipe()
+			defer newRemote.Close()
+			conn := newConnection(agent, newLocal)
+			answer, err := agent.handleConnect(conn, connectRequest("single_b", 2))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer[0], convey.ShouldEqual, ACK_CONN_OK)
+			convey.So(endian.Uint32(answer[12:16]), convey.ShouldEqual, agent.creation)
+			current, _ := agent.findConn("single_b")
+			convey.So(current, convey.ShouldEqual, conn)
+			<-old.closed
+			conn.Close()
+		})
+	})
+}
+
+func TestCallContext(t *testing.T) {
+	convey.Convey("Call waits the ack within ctx", t, func() {
+		agent := New("call_ctx@localhost")
+		agent.isStop.Store(true)
+		local, remote := net.Pipe()
+		defer remote.Close()
+		// 对端不读也不应答。
+		conn := newConnection(agent, local)
+		conn.name = "silent"
+		conn.start()
+		agent.connections["silent"] = conn
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := agent.CallTo(ctx, "silent", base.RoutineId(1), []byte("ping"))
+		convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+		err = agent.replyTo(ctx, conn, 1, []byte("pong"))
+		convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+	})
+}
+
+// 节点 name 以 creation 发起连接的 REQ_CONN 。
+func connectRequest(name string, creation uint32) []byte {
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushByte(ACK_CONN_IS_NOT_RETURN).
+		PushUint16(9999).
+		PushUint16(uint16(len(name))).
+		PushString(name).
+		PushUint16(uint16(len("localhost"))).
+		PushString("localhost").
+		PushByte(0).
+		PushByte(0).
+		PushUint16(PROTOCOL_VERSION).
+		PushUint64(CAPABILITIES).
+		PushUint32(creation)
+	return requestBuf.Bytes()
+}
+
+// 启动一组已经注册到 GPMD 并且两两互相连接的 agent 。
+func startAgents(gpmdPort uint16, names ...string) []*Agent {
+	return startAgentsWith(gpmdPort, nil, names...)
+}
+
+// 与 startAgents 相同，在建立连接之前对每个 agent 调用 setup 。
+func startAgentsWith(gpmdPort uint16, setup func(*Agent), names ...string) []*Agent {
+	agents := make([]*Agent, len(names))
+	for i, name := range names {
+		agent := New(name + "@localhost")
+		agent.SetGPMD("localhost", gpmdPort)
+		if setup != nil {
+			setup(agent)
+		}
+		agent.Listen()
+		agent.Register()
+		go agent.Serve()
+		agents[i] = agent
+	}
+	for i, agent := range agents {
+		for _, target := range agents[i+1:] {
+			agent.QueryNode(target.Node().FullName())
+			agent.ConnectTo(target.Name())
+		}
+	}
+	// 等待双方都持有连接。
+	for _, agent := range agents {
+		for _, target := range agents {
+			for agent != target && !agent.connExist(target.Name()) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	return agents
+}
+
+func stopAgents(agents []*Agent) {
+	for _, agent := range agents {
+		agent.Stop()
+		agent.Stopped()
+	}
+}
+
+// 等待异步状态满足条件，超时返回 false 。
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
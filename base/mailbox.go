@@ -0,0 +1,245 @@
+package base
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Routine 的 Channel 写满时的处理方式。
+type OverflowPolicy uint8
+
+const (
+	// 阻塞直到有空位。 Timeout 大于 0 时最多等待 Timeout ，超时按 OVERFLOW_REJECT
+	// 处理。
+	OVERFLOW_BLOCK OverflowPolicy = iota
+	// 丢弃新到的消息。
+	OVERFLOW_DROP_NEWEST
+	// 丢弃最早的消息，为新消息腾出空位。
+	OVERFLOW_DROP_OLDEST
+	// 拒绝新消息，发送方会收到 DELIVER_FULL 。
+	OVERFLOW_REJECT
+	// 写满之后在 Channel 之外排队，不限制数量。
+	OVERFLOW_UNBOUNDED
+)
+
+// 投递消息的结果。
+type DeliverResult uint8
+
+const (
+	DELIVER_OK DeliverResult = iota
+	// 消息按照 OVERFLOW_DROP_NEWEST 或 OVERFLOW_DROP_OLDEST 被丢弃。
+	DELIVER_DROPPED
+	// 信箱已满，消息被拒绝。
+	DELIVER_FULL
+	// Routine 已经退出。
+	DELIVER_CLOSED
+)
+
+// 按照 Overflow 投递一条消息。
+func (r *Routine) Deliver(message []byte) DeliverResult {
+	return r.DeliverEncoded(0, message)
+}
+
+// 与 Deliver 相同，但 OVERFLOW_BLOCK 没有设置 Timeout 时最多等待 limit ， limit
+// 不大于 0 时信箱已满直接返回 DELIVER_FULL 。用于不能无限阻塞的调用方，例如连接的
+// 读协程。
+func (r *Routine) DeliverWithin(message []byte, limit time.Duration) DeliverResult {
+	return r.DeliverEncodedWithin(0, message, limit)
+}
+
+// 投递一条由 codec 编码的消息， codec 为 0 时表示没有编码。 Routine 设置了 Typed
+// 或者 codec 不为 0 时，写入 Channel 的消息为 | codec | data | 。
+func (r *Routine) DeliverEncoded(codec byte, data []byte) DeliverResult {
+	return r.deliver(r.envelope(codec, data), r.Timeout)
+}
+
+// 与 DeliverEncoded 相同，等待时间见 DeliverWithin 。
+func (r *Routine) DeliverEncodedWithin(codec byte, data []byte, limit time.Duration) DeliverResult {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = limit
+	}
+	if timeout <= 0 {
+		timeout = noWait
+	}
+	return r.deliver(r.envelope(codec, data), timeout)
+}
+
+func (r *Routine) envelope(codec byte, data []byte) []byte {
+	if !r.Typed && codec == 0 {
+		return data
+	}
+	return append([]byte{codec}, data...)
+}
+
+// 传给 deliver 时 OVERFLOW_BLOCK 不等待。
+const noWait time.Duration = -1
+
+// timeout 为 OVERFLOW_BLOCK 的最长等待时间，为 0 时一直阻塞，为 noWait 时不等待。
+func (r *Routine) deliver(message []byte, timeout time.Duration) (result DeliverResult) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("godist: get cast failed: %s", err)
+			result = DELIVER_CLOSED
+		}
+	}()
+	switch r.Overflow {
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case r.Channel <- message:
+			return DELIVER_OK
+		default:
+			atomic.AddUint64(&r.dropped, 1)
+			return DELIVER_DROPPED
+		}
+	case OVERFLOW_DROP_OLDEST:
+		result = DELIVER_OK
+		for {
+			select {
+			case r.Channel <- message:
+				return result
+			default:
+			}
+			select {
+			case <-r.Channel:
+				atomic.AddUint64(&r.dropped, 1)
+				result = DELIVER_DROPPED
+			default:
+			}
+		}
+	case OVERFLOW_REJECT:
+		select {
+		case r.Channel <- message:
+			return DELIVER_OK
+		default:
+			atomic.AddUint64(&r.rejected, 1)
+			return DELIVER_FULL
+		}
+	case OVERFLOW_UNBOUNDED:
+		return r.backlog.push(r.Channel, message, &r.dropped)
+	}
+	if timeout == noWait {
+		select {
+		case r.Channel <- message:
+			return DELIVER_OK
+		default:
+			atomic.AddUint64(&r.rejected, 1)
+			return DELIVER_FULL
+		}
+	}
+	if timeout <= 0 {
+		r.Channel <- message
+		return DELIVER_OK
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r.Channel <- message:
+		return DELIVER_OK
+	case <-timer.C:
+		atomic.AddUint64(&r.rejected, 1)
+		return DELIVER_FULL
+	}
+}
+
+// 按照 policy 向 Requests 投递，不会无限阻塞：只有 OVERFLOW_BLOCK 并且 timeout
+// 大于 0 时最多等待 timeout ； OVERFLOW_DROP_OLDEST 丢弃最早的一项并返回
+// DELIVER_DROPPED ；其他情况返回 DELIVER_FULL ，由调用方决定是拒绝还是丢弃。
+func offer[T any](ch chan T, item T, policy OverflowPolicy, timeout time.Duration) DeliverResult {
+	select {
+	case ch <- item:
+		return DELIVER_OK
+	default:
+	}
+	switch policy {
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- item:
+				return DELIVER_DROPPED
+			default:
+			}
+		}
+	case OVERFLOW_BLOCK:
+		if timeout <= 0 {
+			return DELIVER_FULL
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case ch <- item:
+			return DELIVER_OK
+		case <-timer.C:
+		}
+	}
+	return DELIVER_FULL
+}
+
+// 被丢弃的消息数量。
+func (r *Routine) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// 因为信箱已满被拒绝的消息数量。
+func (r *Routine) Rejected() uint64 {
+	return atomic.LoadUint64(&r.rejected)
+}
+
+// 通道写满之后在通道之外排队的消息，由 pump 按顺序写入通道，不限制数量。
+type overflowQueue[T any] struct {
+	items   []T
+	lock    sync.Mutex
+	pumping bool
+}
+
+// 写入 ch ，写满时排队。 ch 已经关闭时 panic ，由调用方处理。 pump 写入时发现
+// ch 已经关闭，剩下的消息计入 dropped 。
+func (q *overflowQueue[T]) push(ch chan T, item T, dropped *uint64) DeliverResult {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		select {
+		case ch <- item:
+			return DELIVER_OK
+		default:
+		}
+	}
+	q.items = append(q.items, item)
+	if !q.pumping {
+		q.pumping = true
+		go q.pump(ch, dropped)
+	}
+	return DELIVER_OK
+}
+
+func (q *overflowQueue[T]) pump(ch chan T, dropped *uint64) {
+	defer func() {
+		if err := recover(); err != nil {
+			q.lock.Lock()
+			atomic.AddUint64(dropped, uint64(len(q.items)))
+			q.items = nil
+			q.pumping = false
+			q.lock.Unlock()
+		}
+	}()
+	for {
+		q.lock.Lock()
+		if len(q.items) == 0 {
+			q.pumping = false
+			q.lock.Unlock()
+			return
+		}
+		item := q.items[0]
+		q.lock.Unlock()
+		ch <- item
+		q.lock.Lock()
+		q.items = q.items[1:]
+		q.lock.Unlock()
+	}
+}
@@ -0,0 +1,112 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestMailbox(t *testing.T) {
+	convey.Convey("Mailbox overflow", t, func() {
+		convey.Convey("Drop newest", func() {
+			r := &Routine{Channel: make(chan []byte, 1), Overflow: OVERFLOW_DROP_NEWEST}
+			convey.So(r.Deliver([]byte("a")), convey.ShouldEqual, DELIVER_OK)
+			convey.So(r.Deliver([]byte("b")), convey.ShouldEqual, DELIVER_DROPPED)
+			convey.So(r.Dropped(), convey.ShouldEqual, 1)
+			convey.So(<-r.Channel, convey.ShouldResemble, []byte("a"))
+		})
+
+		convey.Convey("Drop oldest", func() {
+			r := &Routine{Channel: make(chan []byte, 1), Overflow: OVERFLOW_DROP_OLDEST}
+			convey.So(r.Deliver([]byte("a")), convey.ShouldEqual, DELIVER_OK)
+			convey.So(r.Deliver([]byte("b")), convey.ShouldEqual, DELIVER_DROPPED)
+			convey.So(r.Dropped(), convey.ShouldEqual, 1)
+			convey.So(<-r.Channel, convey.ShouldResemble, []byte("b"))
+		})
+
+		convey.Convey("Reject", func() {
+			r := &Routine{Channel: make(chan []byte, 1), Overflow: OVERFLOW_REJECT}
+			convey.So(r.Deliver([]byte("a")), convey.ShouldEqual, DELIVER_OK)
+			convey.So(r.Deliver([]byte("b")), convey.ShouldEqual, DELIVER_FULL)
+			convey.So(r.Cast([]byte("b")), convey.ShouldBeFalse)
+			convey.So(r.Rejected(), convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("Block with timeout", func() {
+			r := &Routine{Channel: make(chan []byte, 1), Timeout: 10 * time.Millisecond}
+			convey.So(r.Deliver([]byte("a")), convey.ShouldEqual, DELIVER_OK)
+			convey.So(r.Deliver([]byte("b")), convey.ShouldEqual, DELIVER_FULL)
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				<-r.Channel
+			}()
+			r.Timeout = time.Second
+			convey.So(r.Deliver([]byte("c")), convey.ShouldEqual, DELIVER_OK)
+		})
+
+		convey.Convey("Block within limit", func() {
+			r := &Routine{Channel: make(chan []byte, 1)}
+			convey.So(r.DeliverWithin([]byte("a"), 10*time.Millisecond), convey.ShouldEqual, DELIVER_OK)
+			convey.So(r.DeliverWithin([]byte("b"), 10*time.Millisecond), convey.ShouldEqual, DELIVER_FULL)
+			convey.So(r.Rejected(), convey.ShouldEqual, 1)
+			start := time.Now()
+			convey.So(r.DeliverWithin([]byte("c"), 0), convey.ShouldEqual, DELIVER_FULL)
+			convey.So(time.Since(start), convey.ShouldBeLessThan, 10*time.Millisecond)
+			convey.So(r.Rejected(), convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("Requests and signals", func() {
+			r := &Routine{
+				Channel:  make(chan []byte, 1),
+				Requests: make(chan *Request, 1),
+				Signals:  make(chan Signal, 1),
+				Overflow: OVERFLOW_DROP_OLDEST,
+			}
+			// 信号不按照 Overflow 丢弃。
+			convey.So(r.Signal(Exit{Reason: "a"}), convey.ShouldBeTrue)
+			convey.So(r.Signal(Exit{Reason: "b"}), convey.ShouldBeTrue)
+			convey.So(r.Dropped(), convey.ShouldEqual, 0)
+			convey.So(<-r.Signals, convey.ShouldResemble, Exit{Reason: "a"})
+			convey.So(<-r.Signals, convey.ShouldResemble, Exit{Reason: "b"})
+			// 请求不会被丢弃，只会被拒绝。
+			convey.So(r.Call(NewRequest(nil, nil)), convey.ShouldBeTrue)
+			convey.So(r.Call(NewRequest(nil, nil)), convey.ShouldBeFalse)
+			convey.So(r.Rejected(), convey.ShouldEqual, 1)
+
+			r.Overflow, r.Timeout = OVERFLOW_BLOCK, time.Second
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				<-r.Requests
+			}()
+			convey.So(r.Call(NewRequest(nil, nil)), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("Unbounded keeps order", func() {
+			r := &Routine{Channel: make(chan []byte, 1), Overflow: OVERFLOW_UNBOUNDED}
+			for i := byte(0); i < 10; i++ {
+				convey.So(r.Deliver([]byte{i}), convey.ShouldEqual, DELIVER_OK)
+			}
+			for i := byte(0); i < 10; i++ {
+				convey.So(<-r.Channel, convey.ShouldResemble, []byte{i})
+			}
+		})
+
+		convey.Convey("Encoded", func() {
+			r := &Routine{Channel: make(chan []byte, 3)}
+			r.Deliver([]byte{0x01})
+			r.DeliverEncoded(0x02, []byte{0x03})
+			convey.So(<-r.Channel, convey.ShouldResemble, []byte{0x01})
+			convey.So(<-r.Channel, convey.ShouldResemble, []byte{0x02, 0x03})
+			r.Typed = true
+			r.Deliver([]byte{0x01})
+			convey.So(<-r.Channel, convey.ShouldResemble, []byte{0x00, 0x01})
+		})
+
+		convey.Convey("Closed", func() {
+			r := &Routine{Channel: make(chan []byte, 1)}
+			close(r.Channel)
+			convey.So(r.Deliver([]byte("a")), convey.ShouldEqual, DELIVER_CLOSED)
+		})
+	})
+}
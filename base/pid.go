@@ -0,0 +1,80 @@
+package base
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pid 在集群范围内标识一个 Goroutine 。 Creation 是节点每次启动时生成的编号，用
+// 于区分同名节点的不同运行实例，上一次运行留下的 Pid 会被拒绝。
+type Pid struct {
+	Node     string
+	Creation uint32
+	Id       RoutineId
+}
+
+// e.g. "<player_01.3312.7>"
+func (p Pid) String() string {
+	return fmt.Sprintf("<%s.%d.%d>", p.Node, p.Creation, p.Id)
+}
+
+// 解析 String 输出的格式。
+func ParsePid(s string) (Pid, error) {
+	if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") {
+		return Pid{}, fmt.Errorf("godist.base: invalid pid %q", s)
+	}
+	fields := strings.Split(s[1:len(s)-1], ".")
+	if len(fields) < 3 {
+		return Pid{}, fmt.Errorf("godist.base: invalid pid %q", s)
+	}
+	// 节点名中可能含有 "." ，因此从后向前取。
+	n := len(fields)
+	creation, cErr := strconv.ParseUint(fields[n-2], 10, 32)
+	if cErr != nil {
+		return Pid{}, fmt.Errorf("godist.base: invalid pid %q: %s", s, cErr)
+	}
+	id, iErr := strconv.ParseUint(fields[n-1], 10, 64)
+	if iErr != nil {
+		return Pid{}, fmt.Errorf("godist.base: invalid pid %q: %s", s, iErr)
+	}
+	return Pid{
+		Node:     strings.Join(fields[:n-2], "."),
+		Creation: uint32(creation),
+		Id:       RoutineId(id),
+	}, nil
+}
+
+// Binary described
+// +----------------------------------------------+
+// | name length | name        | creation | id   |
+// |-------------|-------------|----------|------|
+// | 2           | name length | 4        | 8    |
+// +----------------------------------------------+
+func (p Pid) MarshalBinary() ([]byte, error) {
+	if len(p.Node) > 0xffff {
+		return nil, errors.New("godist.base: pid node name too long")
+	}
+	data := make([]byte, 2+len(p.Node)+4+8)
+	binary.LittleEndian.PutUint16(data, uint16(len(p.Node)))
+	copy(data[2:], p.Node)
+	binary.LittleEndian.PutUint32(data[2+len(p.Node):], p.Creation)
+	binary.LittleEndian.PutUint64(data[6+len(p.Node):], uint64(p.Id))
+	return data, nil
+}
+
+func (p *Pid) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errors.New("godist.base: pid data too short")
+	}
+	nameLength := int(binary.LittleEndian.Uint16(data))
+	if len(data) != 2+nameLength+4+8 {
+		return errors.New("godist.base: pid data length mismatch")
+	}
+	p.Node = string(data[2 : 2+nameLength])
+	p.Creation = binary.LittleEndian.Uint32(data[2+nameLength:])
+	p.Id = RoutineId(binary.LittleEndian.Uint64(data[6+nameLength:]))
+	return nil
+}
@@ -0,0 +1,36 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestPid(t *testing.T) {
+	convey.Convey("Init Pid", t, func() {
+		pid := Pid{
+			Node:     "player.01",
+			Creation: 3312,
+			Id:       RoutineId(7),
+		}
+		convey.So(pid.String(), convey.ShouldEqual, "<player.01.3312.7>")
+
+		parsed, err := ParsePid(pid.String())
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(parsed, convey.ShouldResemble, pid)
+		_, err = ParsePid("player.3312.7")
+		convey.So(err, convey.ShouldNotBeNil)
+		_, err = ParsePid("<3312.7>")
+		convey.So(err, convey.ShouldNotBeNil)
+		_, err = ParsePid("<player.x.7>")
+		convey.So(err, convey.ShouldNotBeNil)
+
+		data, err := pid.MarshalBinary()
+		convey.So(err, convey.ShouldBeNil)
+		var decoded Pid
+		convey.So(decoded.UnmarshalBinary(data), convey.ShouldBeNil)
+		convey.So(decoded, convey.ShouldResemble, pid)
+		convey.So(decoded.UnmarshalBinary(data[:3]), convey.ShouldNotBeNil)
+		convey.So(decoded.UnmarshalBinary(nil), convey.ShouldNotBeNil)
+	})
+}
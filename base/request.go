@@ -0,0 +1,44 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Request 是一次 Call 调用投递给 Routine 的请求。处理方需要调用一次 Reply 将结果
+// 返回给调用方，否则调用方会一直等待直到超时。
+type Request struct {
+	Message []byte
+	replied int32
+	reply   func(context.Context, []byte) error
+}
+
+// 创建一个请求。 `reply` 由 godist 提供，用于将结果送回调用方。
+func NewRequest(message []byte, reply func([]byte) error) *Request {
+	return NewRequestContext(message, func(_ context.Context, message []byte) error {
+		return reply(message)
+	})
+}
+
+// 与 NewRequest 相同， `reply` 的等待时间由 ReplyContext 的 ctx 控制。
+func NewRequestContext(message []byte, reply func(context.Context, []byte) error) *Request {
+	return &Request{
+		Message: message,
+		reply:   reply,
+	}
+}
+
+// 向调用方返回结果。每个请求只能回复一次。
+func (r *Request) Reply(message []byte) error {
+	return r.ReplyContext(context.Background(), message)
+}
+
+// 与 Reply 相同，回复需要发往其他节点时， ctx 结束后不再等待对端确认，返回
+// ctx.Err() 。
+func (r *Request) ReplyContext(ctx context.Context, message []byte) error {
+	if !atomic.CompareAndSwapInt32(&r.replied, 0, 1) {
+		return errors.New("godist.base: request already replied")
+	}
+	return r.reply(ctx, message)
+}
@@ -0,0 +1,37 @@
+package base
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequest(t *testing.T) {
+	convey.Convey("Init Request", t, func() {
+		var replied []byte
+		r := NewRequest([]byte("ping"), func(message []byte) error {
+			replied = message
+			return nil
+		})
+		convey.So(r.Message, convey.ShouldResemble, []byte("ping"))
+		convey.So(r.Reply([]byte("pong")), convey.ShouldBeNil)
+		convey.So(replied, convey.ShouldResemble, []byte("pong"))
+		convey.So(r.Reply([]byte("pong")), convey.ShouldNotBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r = NewRequestContext([]byte("ping"), func(ctx context.Context, message []byte) error {
+			return ctx.Err()
+		})
+		convey.So(r.ReplyContext(ctx, []byte("pong")), convey.ShouldEqual, context.Canceled)
+
+		routine := Routine{
+			Channel: make(chan []byte, 1),
+		}
+		convey.So(routine.Call(r), convey.ShouldBeFalse)
+		routine.Requests = make(chan *Request, 1)
+		convey.So(routine.Call(r), convey.ShouldBeTrue)
+		convey.So(<-routine.Requests, convey.ShouldEqual, r)
+	})
+}
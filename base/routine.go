@@ -1,16 +1,42 @@
 package base
 
-import "log"
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
 
 // 使用一个 uint64 保存每个 Goroutine 的 ID 。
 type RoutineId uint64
 
 // 持有每个 Routine 的信息。其中 Channel 字段必须不能是同步通道。否则 Cast 消息
 // 会阻塞。
+//
+// Requests 字段可选，用于接收 Call 请求。为 nil 、已满或者调用过 RejectCalls 时
+// Call 会被拒绝。
+// Signals 字段可选，用于接收 Down 和 Exit 。为 nil 时信号会被丢弃，写满时在
+// Signals 之外排队。
+//
+// Overflow 和 Timeout 决定 Channel 写满时 Cast 的行为，默认一直阻塞。 Requests
+// 写满时同样按照 Overflow 处理，但不会无限阻塞，见 Call 。
+//
+// Typed 为 true 时 Channel 中的每条消息都带有一个字节的 Codec Id 头，没有编码的
+// 消息为 0 ，见 DeliverEncoded 。 Codec Id 由投递方按照发送方给出的 Codec 填写，
+// 不会与消息内容混淆。
 type Routine struct {
-	id      RoutineId
-	idLock  bool
-	Channel chan []byte
+	id          RoutineId
+	idLock      bool
+	Channel     chan []byte
+	Requests    chan *Request
+	Signals     chan Signal
+	Overflow    OverflowPolicy
+	Timeout     time.Duration
+	Typed       bool
+	dropped     uint64
+	rejected    uint64
+	backlog     overflowQueue[[]byte]
+	signalQueue overflowQueue[Signal]
+	noCalls     int32
 }
 
 // 设置 Goroutine 的 ID 。只能够被 godist 自己调用。如果调用了两次，则会抛出
@@ -30,11 +56,55 @@ func (r *Routine) GetId() RoutineId {
 	return r.id
 }
 
-func (r *Routine) Cast(message []byte) {
+// 向 Routine 投递一条消息。如果该 Routine 已经退出或者信箱已满，返回 false 。
+// 需要区分原因时使用 Deliver 。
+func (r *Routine) Cast(message []byte) (accepted bool) {
+	result := r.Deliver(message)
+	return result == DELIVER_OK || result == DELIVER_DROPPED
+}
+
+// 之后的 Call 都会被拒绝，用于没有处理 Call 请求的 Routine 。
+func (r *Routine) RejectCalls() {
+	atomic.StoreInt32(&r.noCalls, 1)
+}
+
+// 向 Routine 投递一个 Call 请求。如果该 Routine 不接受 Call 、 Requests 已满或者
+// 已经退出，返回 false 。调用方可能是连接的读协程，因此 Requests 已满时只有
+// OVERFLOW_BLOCK 并且 Timeout 大于 0 时最多等待 Timeout ，其他情况直接拒绝，请求
+// 不会被丢弃。
+func (r *Routine) Call(request *Request) (accepted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("godist: get call failed: %s", r)
+			accepted = false
+		}
+	}()
+	if r.Requests == nil || atomic.LoadInt32(&r.noCalls) == 1 {
+		return false
+	}
+	policy := r.Overflow
+	if policy == OVERFLOW_DROP_OLDEST {
+		policy = OVERFLOW_REJECT
+	}
+	if offer(r.Requests, request, policy, r.Timeout) != DELIVER_OK {
+		atomic.AddUint64(&r.rejected, 1)
+		return false
+	}
+	return true
+}
+
+// 向 Routine 投递一个信号。如果该 Routine 不接收信号或者已经退出，返回 false 。
+// 监视和链接依赖信号通知退出，因此信号与 Overflow 无关，不会被丢弃： Signals
+// 已满时按照 OVERFLOW_UNBOUNDED 排队，调用方不会阻塞。
+func (r *Routine) Signal(signal Signal) (accepted bool) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("godist: get cast failed: %s", r)
+			log.Printf("godist: get signal failed: %s", r)
+			accepted = false
 		}
 	}()
-	r.Channel <- message
+	if r.Signals == nil {
+		return false
+	}
+	return r.signalQueue.push(r.Signals, signal, &r.dropped) == DELIVER_OK
 }
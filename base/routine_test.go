@@ -26,4 +26,31 @@ func TestRoutine(t *testing.T) {
 		go r.Cast([]byte{'p', 'i', 'n', 'g'})
 		<-c
 	})
+
+	convey.Convey("Call", t, func() {
+		r := Routine{
+			Channel:  make(chan []byte, 1),
+			Requests: make(chan *Request, 1),
+		}
+		convey.So(r.Call(NewRequest(nil, nil)), convey.ShouldBeTrue)
+		// Requests 已满时不阻塞。
+		convey.So(r.Call(NewRequest(nil, nil)), convey.ShouldBeFalse)
+		<-r.Requests
+		r.RejectCalls()
+		convey.So(r.Call(NewRequest(nil, nil)), convey.ShouldBeFalse)
+		convey.So((&Routine{}).Call(NewRequest(nil, nil)), convey.ShouldBeFalse)
+	})
+
+	convey.Convey("Signal", t, func() {
+		r := Routine{
+			Channel: make(chan []byte, 1),
+			Signals: make(chan Signal, 1),
+		}
+		convey.So(r.Signal(Exit{Reason: "a"}), convey.ShouldBeTrue)
+		// Signals 已满时不阻塞，也不丢弃。
+		convey.So(r.Signal(Exit{Reason: "b"}), convey.ShouldBeTrue)
+		convey.So(<-r.Signals, convey.ShouldResemble, Exit{Reason: "a"})
+		convey.So(<-r.Signals, convey.ShouldResemble, Exit{Reason: "b"})
+		convey.So(r.Dropped(), convey.ShouldEqual, 0)
+	})
 }
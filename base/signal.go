@@ -0,0 +1,44 @@
+package base
+
+import "fmt"
+
+// 标识一次监视。由发起监视的节点分配。
+type MonitorRef uint64
+
+// 常用的退出原因。
+const (
+	REASON_NORMAL       = "normal"
+	REASON_NOPROC       = "noproc"
+	REASON_NOCONNECTION = "noconnection"
+	REASON_SHUTDOWN     = "shutdown"
+)
+
+// Signal 是投递给 Routine 的系统消息，为 Down 或者 Exit 。
+type Signal interface {
+	isSignal()
+}
+
+// 被监视的 Goroutine 已经退出，或者与其所在节点的连接已经断开。
+type Down struct {
+	Ref    MonitorRef
+	Pid    Pid
+	Reason string
+}
+
+func (Down) isSignal() {}
+
+func (d Down) String() string {
+	return fmt.Sprintf("DOWN %s %s", d.Pid, d.Reason)
+}
+
+// 链接的 Goroutine 已经退出。
+type Exit struct {
+	From   Pid
+	Reason string
+}
+
+func (Exit) isSignal() {}
+
+func (e Exit) String() string {
+	return fmt.Sprintf("EXIT %s %s", e.From, e.Reason)
+}
@@ -0,0 +1,211 @@
+package godist
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/zhuangsirui/godist/base"
+)
+
+// Codec 负责消息的序列化。每个 Codec 有唯一的 Id ，随消息一起发送，接收方按照
+// Id 选择 Codec 解码，因此收发双方都需要注册同样的 Codec 。
+type Codec interface {
+	Id() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// 内置 Codec 的 Id 。自定义 Codec 不能使用这些 Id 。 CODEC_NONE 表示消息没有经过
+// 编码。
+const (
+	CODEC_NONE   = 0x00
+	CODEC_GOB    = 0x01
+	CODEC_JSON   = 0x02
+	CODEC_BINARY = 0x03
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Id() byte { return CODEC_GOB }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Id() byte { return CODEC_JSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// 紧凑的二进制编码。实现了 encoding.BinaryMarshaler 的值使用其自身的编码，
+// 其余的值必须是 encoding/binary 支持的定长类型。
+type binaryCodec struct{}
+
+func (binaryCodec) Id() byte { return CODEC_BINARY }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if marshaler, ok := v.(encoding.BinaryMarshaler); ok {
+		return marshaler.MarshalBinary()
+	}
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, endian, v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if unmarshaler, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return unmarshaler.UnmarshalBinary(data)
+	}
+	return binary.Read(bytes.NewReader(data), endian, v)
+}
+
+var (
+	GobCodec    Codec = gobCodec{}
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// 注册 Codec 。 Id 已经被注册时返回 ErrCodecRegistered 。
+func (agent *Agent) RegisterCodec(codec Codec) error {
+	agent.codecLock.Lock()
+	defer agent.codecLock.Unlock()
+	if _, exist := agent.codecs[codec.Id()]; exist {
+		return ErrCodecRegistered
+	}
+	agent.codecs[codec.Id()] = codec
+	return nil
+}
+
+// 设置 Encode 默认使用的 Codec ，默认为 CODEC_GOB 。
+func (agent *Agent) SetDefaultCodec(id byte) error {
+	agent.codecLock.Lock()
+	defer agent.codecLock.Unlock()
+	if _, exist := agent.codecs[id]; !exist {
+		return ErrCodecNotFound
+	}
+	agent.defaultCodec = id
+	return nil
+}
+
+// Encoded message described
+// +-----------------------------+
+// | codec id | data            |
+// |----------|-----------------|
+// | 1        | message len - 1 |
+// +-----------------------------+
+//
+// 使用默认 Codec 编码 v ，结果可以作为 Cast 消息发送。发送给 TypedProcess 时使用
+// SendTyped ， Codec Id 随请求发送，而不是作为消息的一部分。
+func (agent *Agent) Encode(v interface{}) ([]byte, error) {
+	return agent.EncodeWith(agent.getDefaultCodec(), v)
+}
+
+// 使用指定的 Codec 编码 v 。
+func (agent *Agent) EncodeWith(id byte, v interface{}) ([]byte, error) {
+	data, err := agent.marshal(id, v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{id}, data...), nil
+}
+
+func (agent *Agent) getDefaultCodec() byte {
+	agent.codecLock.RLock()
+	defer agent.codecLock.RUnlock()
+	return agent.defaultCodec
+}
+
+func (agent *Agent) marshal(id byte, v interface{}) ([]byte, error) {
+	codec, exist := agent.findCodec(id)
+	if !exist {
+		return nil, ErrCodecNotFound
+	}
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCodecFailed, err)
+	}
+	return data, nil
+}
+
+// 按照消息中的 Codec Id 解码到 v 中。
+func (agent *Agent) Decode(message []byte, v interface{}) error {
+	if len(message) == 0 {
+		return ErrCodecNotFound
+	}
+	codec, exist := agent.findCodec(message[0])
+	if !exist {
+		return ErrCodecNotFound
+	}
+	if err := codec.Unmarshal(message[1:], v); err != nil {
+		return fmt.Errorf("%w: %v", ErrCodecFailed, err)
+	}
+	return nil
+}
+
+func (agent *Agent) findCodec(id byte) (Codec, bool) {
+	agent.codecLock.RLock()
+	defer agent.codecLock.RUnlock()
+	codec, exist := agent.codecs[id]
+	return codec, exist
+}
+
+// 使用默认 Codec 编码 value 并发送给 pid 。 Codec Id 与消息分开发送，见 REQ_SEND
+// 的格式。
+func SendTyped[T any](agent *Agent, pid base.Pid, value T) error {
+	codec := agent.getDefaultCodec()
+	data, err := agent.marshal(codec, value)
+	if err != nil {
+		return err
+	}
+	return agent.sendEncoded(pid, codec, data)
+}
+
+// TypedProcess 收到的 Cast 消息会被解码为 T 之后交给 handler 。只有通过 SendTyped
+// 发送的消息带有 Codec Id ，其他消息会被丢弃。
+type TypedProcess[T any] struct {
+	*Process
+}
+
+// 创建一个 TypedProcess 。
+func NewTypedProcess[T any](agent *Agent) *TypedProcess[T] {
+	return &TypedProcess[T]{agent.NewProcessWithMailbox(MailboxOptions{typed: true})}
+}
+
+// 处理解码之后的消息。没有编码或者无法解码的消息会被丢弃。 handler 返回 error
+// 时 Process 退出。
+func (p *TypedProcess[T]) Run(handler func(T) error) {
+	p.Process.Run(func(message []byte) error {
+		if len(message) > 0 && message[0] == CODEC_NONE {
+			log.Printf("godist.codec: Process %d drop message without codec", p.GetId())
+			return nil
+		}
+		var value T
+		if err := p.agent.Decode(message, &value); err != nil {
+			log.Printf("godist.codec: Process %d drop message: %s", p.GetId(), err)
+			return nil
+		}
+		return handler(value)
+	})
+}
@@ -0,0 +1,111 @@
+package godist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+type order struct {
+	Id    uint64
+	Items []string
+}
+
+func TestCodec(t *testing.T) {
+	convey.Convey("Codec", t, func() {
+		agent := New("codec@localhost")
+
+		convey.Convey("Built-in codecs", func() {
+			value := order{Id: 7, Items: []string{"apple", "pear"}}
+			for _, id := range []byte{CODEC_GOB, CODEC_JSON} {
+				message, err := agent.EncodeWith(id, value)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(message[0], convey.ShouldEqual, id)
+				var decoded order
+				convey.So(agent.Decode(message, &decoded), convey.ShouldBeNil)
+				convey.So(decoded, convey.ShouldResemble, value)
+			}
+
+			pid := agent.Pid(base.RoutineId(3))
+			message, err := agent.EncodeWith(CODEC_BINARY, pid)
+			convey.So(err, convey.ShouldBeNil)
+			var decodedPid base.Pid
+			convey.So(agent.Decode(message, &decodedPid), convey.ShouldBeNil)
+			convey.So(decodedPid, convey.ShouldResemble, pid)
+
+			message, err = agent.EncodeWith(CODEC_BINARY, uint32(42))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(message), convey.ShouldEqual, 5)
+			var number uint32
+			convey.So(agent.Decode(message, &number), convey.ShouldBeNil)
+			convey.So(number, convey.ShouldEqual, 42)
+		})
+
+		convey.Convey("Registry", func() {
+			convey.So(agent.RegisterCodec(JSONCodec), convey.ShouldEqual, ErrCodecRegistered)
+			convey.So(agent.SetDefaultCodec(0x7f), convey.ShouldEqual, ErrCodecNotFound)
+			convey.So(agent.SetDefaultCodec(CODEC_JSON), convey.ShouldBeNil)
+			message, _ := agent.Encode(order{Id: 1})
+			convey.So(message[0], convey.ShouldEqual, CODEC_JSON)
+			convey.So(agent.Decode([]byte{0x7f, 1}, &order{}), convey.ShouldEqual, ErrCodecNotFound)
+			_, err := agent.EncodeWith(CODEC_BINARY, "not fixed size")
+			convey.So(err, convey.ShouldWrap, ErrCodecFailed)
+		})
+	})
+}
+
+func TestTypedProcess(t *testing.T) {
+	convey.Convey("Typed process", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgentsWith(gpmdPort, func(agent *Agent) {
+			if agent.Name() == "typed_old" {
+				agent.SetCapabilities(CAPABILITIES &^ CAP_CODEC)
+			}
+		}, "typed_a", "typed_b", "typed_old")
+		a, b, old := agents[0], agents[1], agents[2]
+		process := NewTypedProcess[order](b)
+		received := make(chan order, 1)
+		go process.Run(func(value order) error {
+			received <- value
+			return nil
+		})
+
+		convey.Convey("Plain messages are not decoded", func() {
+			convey.So(a.Send(process.Pid(), []byte("garbage")), convey.ShouldBeNil)
+			// 内容恰好以 Codec Id 开头的普通消息。
+			message, _ := a.EncodeWith(CODEC_JSON, order{Id: 1})
+			convey.So(a.Send(process.Pid(), message), convey.ShouldBeNil)
+			convey.So(b.Send(process.Pid(), message), convey.ShouldBeNil)
+			convey.So(SendTyped(a, process.Pid(), order{Id: 9, Items: []string{"tea"}}), convey.ShouldBeNil)
+			convey.So(<-received, convey.ShouldResemble, order{Id: 9, Items: []string{"tea"}})
+		})
+
+		convey.Convey("Local", func() {
+			convey.So(SendTyped(b, process.Pid(), order{Id: 2}), convey.ShouldBeNil)
+			convey.So(<-received, convey.ShouldResemble, order{Id: 2})
+		})
+
+		convey.Convey("Peer without codec capability", func() {
+			_, capabilities, _ := a.NodeProtocol(old.Name())
+			convey.So(capabilities&CAP_CODEC, convey.ShouldEqual, 0)
+			plain := old.NewProcess()
+			convey.So(SendTyped(a, plain.Pid(), order{Id: 3}), convey.ShouldBeNil)
+			message, err := plain.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			var decoded order
+			convey.So(a.Decode(message.Cast, &decoded), convey.ShouldBeNil)
+			convey.So(decoded, convey.ShouldResemble, order{Id: 3})
+		})
+
+		process.Stop(base.REASON_NORMAL)
+		process.Wait()
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
@@ -0,0 +1,203 @@
+package godist
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync/atomic"
+)
+
+// Compressor 负责连接上帧的压缩。每个 Compressor 有唯一的 Id ，建立连接时双方
+// 交换各自支持的 Id 并选定一个。
+type Compressor interface {
+	Id() byte
+	NewWriter(w io.Writer) io.WriteCloser
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// 内置 Compressor 的 Id 。 COMPRESS_NONE 表示不压缩。
+const (
+	COMPRESS_NONE    = 0x00
+	COMPRESS_DEFLATE = 0x01
+	COMPRESS_GZIP    = 0x02
+)
+
+// 小于该长度的帧不压缩。
+const DEFAULT_COMPRESS_THRESHOLD = 1024
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Id() byte { return COMPRESS_DEFLATE }
+
+func (deflateCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	// 只有压缩级别错误时才会返回 error 。
+	writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return writer
+}
+
+func (deflateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Id() byte { return COMPRESS_GZIP }
+
+func (gzipCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	DeflateCompressor Compressor = deflateCompressor{}
+	GzipCompressor    Compressor = gzipCompressor{}
+)
+
+// 设置建立连接时提供的 Compressor ，按优先顺序排列。双方都支持的 Compressor 中
+// 发起连接一方最优先的被选中；没有共同支持的 Compressor 时不压缩。不小于
+// threshold 的请求和应答会被压缩，压缩后没有变小的按原样发送。不调用时不压缩。
+// 只对之后建立的连接生效。
+func (a *Agent) SetCompression(threshold int, compressors ...Compressor) {
+	a.compressMin = threshold
+	a.compressors = compressors
+}
+
+func (a *Agent) findCompressor(id byte) (Compressor, bool) {
+	for _, compressor := range a.compressors {
+		if compressor.Id() == id {
+			return compressor, true
+		}
+	}
+	return nil, false
+}
+
+// 从对端提供的 Id 中选出第一个本节点也支持的 Compressor 。
+func (a *Agent) negotiateCompressor(ids []byte) Compressor {
+	for _, id := range ids {
+		if compressor, exist := a.findCompressor(id); exist {
+			return compressor
+		}
+	}
+	return nil
+}
+
+// 连接上压缩帧的统计。 Raw 为压缩前的字节数， Compressed 为压缩后的字节数，
+// 只统计被压缩的帧。
+type CompressionStats struct {
+	Compressor    byte
+	RawOut        uint64
+	CompressedOut uint64
+	RawIn         uint64
+	CompressedIn  uint64
+}
+
+// 发送方向的压缩率，即压缩后与压缩前的字节数之比。没有压缩过的帧时为 1 。
+func (s CompressionStats) Ratio() float64 {
+	if s.RawOut == 0 {
+		return 1
+	}
+	return float64(s.CompressedOut) / float64(s.RawOut)
+}
+
+// 返回到 nodeName 节点的连接的压缩统计。没有连接时返回 false 。
+func (agent *Agent) CompressionStats(nodeName string) (CompressionStats, bool) {
+	conn, exist := agent.findConn(nodeName)
+	if !exist {
+		return CompressionStats{}, false
+	}
+	return conn.compressionStats(), true
+}
+
+type compressionCounter struct {
+	rawOut        uint64
+	compressedOut uint64
+	rawIn         uint64
+	compressedIn  uint64
+}
+
+func (c *connection) compressionStats() CompressionStats {
+	stats := CompressionStats{
+		RawOut:        atomic.LoadUint64(&c.counter.rawOut),
+		CompressedOut: atomic.LoadUint64(&c.counter.compressedOut),
+		RawIn:         atomic.LoadUint64(&c.counter.rawIn),
+		CompressedIn:  atomic.LoadUint64(&c.counter.compressedIn),
+	}
+	if compressor := c.getCompressor(); compressor != nil {
+		stats.Compressor = compressor.Id()
+	}
+	return stats
+}
+
+// 握手完成时设置选定的 Compressor ，此时读写协程已经启动。
+func (c *connection) setCompressor(compressor Compressor) {
+	c.stateLock.Lock()
+	c.compressor = compressor
+	c.stateLock.Unlock()
+}
+
+func (c *connection) getCompressor() Compressor {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.compressor
+}
+
+// Compressed body described
+// +---------------------------+
+// | compressor | data         |
+// |------------|--------------|
+// | 1          | body length  |
+// +---------------------------+
+//
+// 压缩 body 。没有选定 Compressor 、 body 小于阈值或者压缩后没有变小时返回
+// false 。压缩后的 body 带有 Compressor Id ，接收方不需要等待握手应答处理完成
+// 就可以解压，双方共用一条连接时对端可能在握手应答之后立即发送压缩的请求。
+func (c *connection) compress(body []byte) ([]byte, bool) {
+	compressor := c.getCompressor()
+	if compressor == nil || len(body) < c.compressMin || !c.supports(CAP_COMPRESS) {
+		return nil, false
+	}
+	buffer := bytes.NewBuffer([]byte{compressor.Id()})
+	writer := compressor.NewWriter(buffer)
+	if _, err := writer.Write(body); err != nil {
+		return nil, false
+	}
+	if err := writer.Close(); err != nil {
+		return nil, false
+	}
+	if buffer.Len() >= len(body) {
+		return nil, false
+	}
+	atomic.AddUint64(&c.counter.rawOut, uint64(len(body)))
+	atomic.AddUint64(&c.counter.compressedOut, uint64(buffer.Len()))
+	return buffer.Bytes(), true
+}
+
+// 解压 body ，解压后超过最大长度时返回 ErrMessageTooLarge 。
+func (c *connection) decompress(body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, ErrBadFrame
+	}
+	compressor, exist := c.agent.findCompressor(body[0])
+	if !exist {
+		return nil, ErrBadFrame
+	}
+	reader, err := compressor.NewReader(bytes.NewReader(body[1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, int64(c.maxMessageSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) > c.maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	atomic.AddUint64(&c.counter.rawIn, uint64(len(data)))
+	atomic.AddUint64(&c.counter.compressedIn, uint64(len(body)))
+	return data, nil
+}
@@ -0,0 +1,76 @@
+package godist
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestCompression(t *testing.T) {
+	convey.Convey("Compression", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgentsWith(gpmdPort, func(agent *Agent) {
+			switch agent.Name() {
+			case "compress_a":
+				agent.SetCompression(1024, GzipCompressor, DeflateCompressor)
+			case "compress_b":
+				agent.SetCompression(1024, DeflateCompressor)
+			}
+		}, "compress_a", "compress_b", "compress_c")
+		a, b, c := agents[0], agents[1], agents[2]
+
+		convey.Convey("Negotiate", func() {
+			stats, exist := a.CompressionStats(b.Name())
+			convey.So(exist, convey.ShouldBeTrue)
+			convey.So(stats.Compressor, convey.ShouldEqual, COMPRESS_DEFLATE)
+			stats, _ = b.CompressionStats(a.Name())
+			convey.So(stats.Compressor, convey.ShouldEqual, COMPRESS_DEFLATE)
+			stats, _ = a.CompressionStats(c.Name())
+			convey.So(stats.Compressor, convey.ShouldEqual, COMPRESS_NONE)
+			_, exist = a.CompressionStats("compress_none")
+			convey.So(exist, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Compress large casts", func() {
+			process := b.NewProcess()
+			small := []byte(`{"id":1}`)
+			convey.So(a.Send(process.Pid(), small), convey.ShouldBeNil)
+			stats, _ := a.CompressionStats(b.Name())
+			convey.So(stats.RawOut, convey.ShouldEqual, 0)
+			convey.So(stats.Ratio(), convey.ShouldEqual, 1)
+
+			large := bytes.Repeat([]byte(`{"id":1,"name":"player","score":100},`), 1000)
+			convey.So(a.Send(process.Pid(), large), convey.ShouldBeNil)
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, small)
+			message, err = process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(bytes.Equal(message.Cast, large), convey.ShouldBeTrue)
+
+			stats, _ = a.CompressionStats(b.Name())
+			convey.So(stats.RawOut, convey.ShouldBeGreaterThan, len(large))
+			convey.So(stats.Ratio(), convey.ShouldBeLessThan, 0.1)
+		})
+
+		convey.Convey("Without common compressor", func() {
+			process := c.NewProcess()
+			large := bytes.Repeat([]byte("payload"), 1000)
+			convey.So(a.Send(process.Pid(), large), convey.ShouldBeNil)
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(bytes.Equal(message.Cast, large), convey.ShouldBeTrue)
+			stats, _ := a.CompressionStats(c.Name())
+			convey.So(stats.RawOut, convey.ShouldEqual, 0)
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
@@ -0,0 +1,401 @@
+package godist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhuangsirui/binpacker"
+)
+
+const (
+	FRAME_REQUEST = 0x01
+	FRAME_ANSWER  = 0x02
+	FRAME_TICK    = 0x03
+	FRAME_CHUNK   = 0x04
+
+	// 帧类型的最高位表示 body 经过了压缩。
+	FRAME_COMPRESSED = 0x80
+
+	// 超过该长度的请求和应答会被拆分为多个分片帧发送。
+	FRAME_CHUNK_SIZE = 64 * 1024
+
+	// 一条连接上正在接收的分片总长度不能超过最大消息长度的倍数。
+	FRAME_CHUNK_BUFFER_MESSAGES = 4
+)
+
+// connection 持有与一个节点之间的 TCP 连接。连接由一个读协程和一个写协程独占，
+// 每一帧都带有请求 ID ，应答按 ID 交还给对应的请求方，因此多个 Goroutine 可以
+// 同时在一条连接上发送请求。
+type connection struct {
+	agent          *Agent
+	name           string
+	conn           net.Conn
+	writeQueue     chan []byte
+	pending        map[uint64]chan []byte
+	pendingLock    *sync.Mutex
+	requestCounter uint64
+	closed         chan bool
+	closeOnce      *sync.Once
+	closeReason    string
+	lastRead       int64
+	lastWrite      int64
+	maxMessageSize uint64
+	compressor     Compressor
+	stateLock      *sync.RWMutex
+	compressMin    int
+	counter        compressionCounter
+	challenge      []byte
+	peerChallenge  []byte
+	authenticated  int32
+	version        uint16
+	capabilities   uint64
+	outbound       bool
+	peerCreation   uint32
+}
+
+func newConnection(agent *Agent, conn net.Conn) *connection {
+	now := time.Now().UnixNano()
+	return &connection{
+		agent:          agent,
+		conn:           conn,
+		writeQueue:     make(chan []byte, 100),
+		pending:        make(map[uint64]chan []byte),
+		pendingLock:    new(sync.Mutex),
+		closed:         make(chan bool),
+		closeOnce:      new(sync.Once),
+		stateLock:      new(sync.RWMutex),
+		lastRead:       now,
+		lastWrite:      now,
+		maxMessageSize: agent.maxMessageSize,
+		compressMin:    agent.compressMin,
+		capabilities:   agent.capabilities,
+	}
+}
+
+// 对端运行实例的标识，握手时设置，其他连接的读协程在 Agent.acceptConn 中读取。
+func (c *connection) setPeerCreation(creation uint32) {
+	c.stateLock.Lock()
+	c.peerCreation = creation
+	c.stateLock.Unlock()
+}
+
+func (c *connection) getPeerCreation() uint32 {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.peerCreation
+}
+
+// 启动读写协程。
+func (c *connection) start() {
+	go c.readLoop()
+	go c.writeLoop()
+	if c.agent.tickInterval > 0 {
+		go c.tickLoop(c.agent.tickInterval, c.agent.tickMissed)
+	}
+}
+
+// 发送一个请求并等待对端应答。连接关闭时返回 ErrConnectionClosed 。
+func (c *connection) request(code byte, request []byte) ([]byte, error) {
+	return c.requestContext(context.Background(), code, request)
+}
+
+// 与 request 相同， ctx 结束时不再等待写队列或者应答，返回 ctx.Err() 。
+func (c *connection) requestContext(ctx context.Context, code byte, request []byte) ([]byte, error) {
+	if !c.supports(requestCapability(code)) {
+		return nil, ErrNotSupported
+	}
+	requestId := atomic.AddUint64(&c.requestCounter, 1)
+	answerChan := make(chan []byte, 1)
+	c.pendingLock.Lock()
+	c.pending[requestId] = answerChan
+	c.pendingLock.Unlock()
+	defer func() {
+		c.pendingLock.Lock()
+		delete(c.pending, requestId)
+		c.pendingLock.Unlock()
+	}()
+	if err := c.writeFrameContext(ctx, FRAME_REQUEST, requestId, append([]byte{code}, request...)); err != nil {
+		return nil, err
+	}
+	select {
+	case answer := <-answerChan:
+		return answer, nil
+	case <-c.closed:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 回应对端的请求。
+func (c *connection) answer(requestId uint64, answer []byte) error {
+	return c.writeFrame(FRAME_ANSWER, requestId, answer)
+}
+
+// Chunk frame body described
+// +---------------------------+
+// | kind | last | data        |
+// |------|------|-------------|
+// | 1    | 1    | body length |
+// +---------------------------+
+//
+// body 先按照 connection.compress 压缩，再把超过 FRAME_CHUNK_SIZE 的 body 按顺序
+// 拆分为多个 FRAME_CHUNK 帧， request id 与原帧相同， kind 为原帧的类型，最后一个
+// 分片的 last 为 1 。分片逐个放入写队列，其他请求可以穿插在分片之间发送，不会被
+// 大消息阻塞。
+func (c *connection) writeFrame(kind byte, requestId uint64, body []byte) error {
+	return c.writeFrameContext(context.Background(), kind, requestId, body)
+}
+
+// 与 writeFrame 相同， ctx 结束时不再等待写队列。第一个分片放入写队列之后剩余的
+// 分片仍然会发送完，避免对端留下不完整的消息。
+func (c *connection) writeFrameContext(ctx context.Context, kind byte, requestId uint64, body []byte) error {
+	if uint64(len(body)) > c.maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	if compressed, ok := c.compress(body); ok {
+		kind, body = kind|FRAME_COMPRESSED, compressed
+	}
+	if len(body) <= FRAME_CHUNK_SIZE || !c.supports(CAP_CHUNK) {
+		return c.writeContext(ctx, packFrame(kind, requestId, body))
+	}
+	for offset := 0; offset < len(body); offset += FRAME_CHUNK_SIZE {
+		end := offset + FRAME_CHUNK_SIZE
+		var last byte
+		if end >= len(body) {
+			end, last = len(body), 1
+		}
+		chunk := append([]byte{kind, last}, body[offset:end]...)
+		if err := c.writeContext(ctx, packFrame(FRAME_CHUNK, requestId, chunk)); err != nil {
+			return err
+		}
+		ctx = context.Background()
+	}
+	return nil
+}
+
+func packFrame(kind byte, requestId uint64, body []byte) []byte {
+	frameBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, frameBuf).
+		PushByte(kind).
+		PushUint64(requestId).
+		PushBytes(body)
+	return binpacker.AddUint64Perfix(frameBuf.Bytes())
+}
+
+func (c *connection) write(frame []byte) error {
+	return c.writeContext(context.Background(), frame)
+}
+
+func (c *connection) writeContext(ctx context.Context, frame []byte) error {
+	select {
+	case c.writeQueue <- frame:
+		return nil
+	case <-c.closed:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 关闭连接。所有等待应答的请求都会返回 ErrConnectionClosed 。
+func (c *connection) Close() {
+	c.closeWithReason(NODE_DOWN_CLOSED)
+}
+
+// 以 reason 关闭连接。只有第一次关闭的原因会被记录。
+func (c *connection) closeWithReason(reason string) {
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.closed)
+		c.conn.Close()
+		c.agent.unregisterConn(c)
+	})
+}
+
+func (c *connection) writeLoop() {
+	for {
+		select {
+		case frame := <-c.writeQueue:
+			if _, err := c.conn.Write(frame); err != nil {
+				log.Printf("godist.conn write to %s error: %s", c.name, err)
+				c.closeWithReason(err.Error())
+				return
+			}
+			atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Frame described
+// +-----------------------------------------+
+// | length | kind | request id | body       |
+// |--------|------|------------|------------|
+// | 8      | 1    | 8          | length - 9 |
+// +-----------------------------------------+
+//
+// 请求帧的 body 为 | code | request | ，应答帧的 body 为对应请求的 answer 。
+// 心跳帧的 request id 为 0 ，没有 body 。分片帧见 connection.writeFrame ，一条
+// 连接上正在接收的分片总长度超过 FRAME_CHUNK_BUFFER_MESSAGES 倍最大消息长度时关闭
+// 连接。需要验证的连接在通过验证之前只能发送未压缩的完整帧。
+func (c *connection) readLoop() {
+	defer c.Close()
+	// 正在接收的分片，按原帧的类型和 request id 区分。
+	chunks := make(map[chunkKey][]byte)
+	var buffered uint64
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			if err == io.EOF {
+				c.closeWithReason(NODE_DOWN_PEER_CLOSED)
+			} else {
+				log.Printf("godist.conn read from %s error: %s", c.name, err)
+				c.closeWithReason(err.Error())
+			}
+			return
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		kind, requestId, body := frame[0], endian.Uint64(frame[1:9]), frame[9:]
+		if (kind == FRAME_CHUNK || kind&FRAME_COMPRESSED != 0) && !c.agent.verified(c) {
+			// 没有通过验证之前不缓存分片，也不解压。
+			log.Printf("godist.conn frame kind %d from unverified peer", kind)
+			c.closeWithReason(ErrAuthFailed.Error())
+			return
+		}
+		if kind == FRAME_CHUNK {
+			if len(body) < 2 {
+				log.Printf("godist.conn bad chunk from %s", c.name)
+				return
+			}
+			key := chunkKey{body[0], requestId}
+			data := append(chunks[key], body[2:]...)
+			buffered += uint64(len(body) - 2)
+			if uint64(len(data)) > c.maxMessageSize || buffered > c.maxMessageSize*FRAME_CHUNK_BUFFER_MESSAGES {
+				log.Printf("godist.conn message from %s too large", c.name)
+				c.closeWithReason(ErrMessageTooLarge.Error())
+				return
+			}
+			if body[1] == 0 {
+				chunks[key] = data
+				continue
+			}
+			delete(chunks, key)
+			buffered -= uint64(len(data))
+			kind, body = key.kind, data
+		}
+		if kind&FRAME_COMPRESSED != 0 {
+			data, err := c.decompress(body)
+			if err != nil {
+				log.Printf("godist.conn decompress frame from %s error: %s", c.name, err)
+				c.closeWithReason(err.Error())
+				return
+			}
+			kind, body = kind&^FRAME_COMPRESSED, data
+		}
+		switch kind {
+		case FRAME_TICK:
+		case FRAME_REQUEST:
+			if len(body) == 0 {
+				log.Printf("godist.conn empty request from %s", c.name)
+				return
+			}
+			// 在读协程中顺序处理，保证同一连接上消息的先后顺序。
+			answer, err := c.agent.dispatchRequest(c, requestId, body[0], body[1:])
+			if err == errAnswerLater {
+				continue
+			}
+			if err != nil {
+				log.Printf("godist.conn request from %s error: %s", c.name, err)
+				return
+			}
+			if err := c.answer(requestId, answer); err != nil {
+				return
+			}
+		case FRAME_ANSWER:
+			c.pendingLock.Lock()
+			answerChan, exist := c.pending[requestId]
+			c.pendingLock.Unlock()
+			// 同一个请求的应答只接收一次，重复的应答不能阻塞读协程。
+			if exist {
+				select {
+				case answerChan <- body:
+				default:
+					log.Printf("godist.conn duplicate answer %d from %s", requestId, c.name)
+				}
+			}
+		default:
+			log.Printf("godist.conn unknown frame kind %d from %s", kind, c.name)
+			return
+		}
+	}
+}
+
+// 连接空闲时发送心跳，连续 missed 个间隔没有读到数据时关闭连接。
+func (c *connection) tickLoop(interval time.Duration, missed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	tick := make([]byte, 9)
+	tick[0] = FRAME_TICK
+	tick = binpacker.AddUint64Perfix(tick)
+	for {
+		select {
+		case <-ticker.C:
+			if !c.supports(CAP_TICK) {
+				// 对端不发送心跳，无法判断是否失效。
+				return
+			}
+			now := time.Now().UnixNano()
+			if time.Duration(now-atomic.LoadInt64(&c.lastRead)) > interval*time.Duration(missed) {
+				log.Printf("godist.conn node %s heartbeat timeout", c.name)
+				c.closeWithReason(NODE_DOWN_TICK_TIMEOUT)
+				return
+			}
+			if time.Duration(now-atomic.LoadInt64(&c.lastWrite)) >= interval/2 {
+				// 写队列已满说明连接并不空闲，不需要心跳。
+				select {
+				case c.writeQueue <- tick:
+				default:
+				}
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// 处理函数会在其他 Goroutine 中以 connection.answer 应答，读协程不需要应答。
+var errAnswerLater = errors.New("godist: answer later")
+
+type chunkKey struct {
+	kind      byte
+	requestId uint64
+}
+
+func (c *connection) readFrame() ([]byte, error) {
+	lengthBuffer := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, lengthBuffer); err != nil {
+		return nil, err
+	}
+	length := endian.Uint64(lengthBuffer)
+	if length < 9 {
+		return nil, errors.New("godist: frame too short")
+	}
+	// 分片帧比原帧多 2 字节的分片头。
+	if length > c.maxMessageSize+11 {
+		return nil, ErrMessageTooLarge
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,208 @@
+package godist
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/binpacker"
+)
+
+func TestConnection(t *testing.T) {
+	convey.Convey("Connection", t, func() {
+		agent := New("conn@localhost")
+		client, server := startConnPair(agent, nil)
+
+		convey.Convey("Concurrent requests", func() {
+			count := 50
+			answers := make(chan []byte, count)
+			var wg sync.WaitGroup
+			for i := 0; i < count; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					answer, _ := client.request(REQ_REPLY, make([]byte, 16))
+					answers <- answer
+				}()
+			}
+			wg.Wait()
+			close(answers)
+			for answer := range answers {
+				convey.So(answer, convey.ShouldResemble, []byte{ACK_REPLY_CALL_NOT_FOUND})
+			}
+		})
+
+		convey.Convey("Bad request closes connection", func() {
+			_, err := client.request(0xff, nil)
+			convey.So(err, convey.ShouldEqual, ErrConnectionClosed)
+			_, err = client.request(REQ_REPLY, make([]byte, 16))
+			convey.So(err, convey.ShouldEqual, ErrConnectionClosed)
+		})
+
+		convey.Convey("Large message", func() {
+			process := agent.NewProcess()
+			message := bytes.Repeat([]byte("0123456789abcdef"), 2<<20)
+			done := make(chan []byte, 1)
+			go func() {
+				answer, _ := client.request(REQ_CAST, castBody(process, message))
+				done <- answer
+			}()
+			// 大消息的分片之间可以穿插其他请求。
+			convey.So(waitFor(func() bool { return len(client.writeQueue) > 0 }), convey.ShouldBeTrue)
+			answer, err := client.request(REQ_REPLY, make([]byte, 16))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_REPLY_CALL_NOT_FOUND})
+			convey.So(done, convey.ShouldBeEmpty)
+			convey.So(<-done, convey.ShouldResemble, []byte{ACK_CAST_OK})
+			convey.So(bytes.Equal(<-process.Channel, message), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("Message too large", func() {
+			process := agent.NewProcess()
+			small, peer := startConnPair(agent, func(client, server *connection) {
+				client.maxMessageSize = 1 << 20
+			})
+			_, err := small.request(REQ_CAST, castBody(process, make([]byte, 2<<20)))
+			convey.So(err, convey.ShouldEqual, ErrMessageTooLarge)
+			small.Close()
+			peer.Close()
+
+			large, peer := startConnPair(agent, func(client, server *connection) {
+				server.maxMessageSize = 1 << 20
+			})
+			_, err = large.request(REQ_CAST, castBody(process, make([]byte, 2<<20)))
+			convey.So(err, convey.ShouldEqual, ErrConnectionClosed)
+			<-peer.closed
+			convey.So(peer.closeReason, convey.ShouldEqual, ErrMessageTooLarge.Error())
+			large.Close()
+		})
+
+		convey.Convey("Chunk buffer limit", func() {
+			sender, peer := startConnPair(agent, func(client, server *connection) {
+				server.maxMessageSize = 1 << 20
+			})
+			// 每条消息都没有超过最大长度，但是同时接收的分片总长度超过了限制。
+			for requestId := uint64(1); requestId <= FRAME_CHUNK_BUFFER_MESSAGES+1; requestId++ {
+				chunk := append([]byte{FRAME_REQUEST, 0}, make([]byte, 1<<20-16)...)
+				sender.write(packFrame(FRAME_CHUNK, requestId, chunk))
+			}
+			select {
+			case <-peer.closed:
+				convey.So(peer.closeReason, convey.ShouldEqual, ErrMessageTooLarge.Error())
+			case <-time.After(time.Second):
+				convey.So("connection still open", convey.ShouldBeEmpty)
+			}
+			sender.Close()
+		})
+
+		convey.Convey("Full write queue", func() {
+			local, remote := net.Pipe()
+			stalled := newConnection(agent, local)
+			for len(stalled.writeQueue) < cap(stalled.writeQueue) {
+				stalled.writeQueue <- nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := stalled.requestContext(ctx, REQ_REPLY, make([]byte, 16))
+			convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+			stalled.Close()
+			remote.Close()
+		})
+
+		convey.Convey("Duplicate answer", func() {
+			answerChan := make(chan []byte, 1)
+			client.pendingLock.Lock()
+			client.pending[1<<32] = answerChan
+			client.pendingLock.Unlock()
+			server.answer(1<<32, []byte{1})
+			server.answer(1<<32, []byte{2})
+			convey.So(<-answerChan, convey.ShouldResemble, []byte{1})
+			// 读协程没有被重复的应答阻塞。
+			answer, err := client.request(REQ_REPLY, make([]byte, 16))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_REPLY_CALL_NOT_FOUND})
+		})
+
+		client.Close()
+		server.Close()
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	convey.Convey("Heartbeat", t, func() {
+		agent := New("tick@localhost")
+		agent.SetNetTick(20*time.Millisecond, 3)
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		convey.So(err, convey.ShouldBeNil)
+		defer listener.Close()
+		accepted := make(chan *net.TCPConn, 1)
+		go func() {
+			tcpConn, _ := listener.AcceptTCP()
+			accepted <- tcpConn
+		}()
+		tcpConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		convey.So(err, convey.ShouldBeNil)
+		client := newConnection(agent, tcpConn)
+		client.start()
+		peer := <-accepted
+
+		convey.Convey("Idle connection stays alive", func() {
+			server := newConnection(agent, peer)
+			server.start()
+			time.Sleep(200 * time.Millisecond)
+			select {
+			case <-client.closed:
+				convey.So(client.closeReason, convey.ShouldBeEmpty)
+			default:
+			}
+			server.Close()
+		})
+
+		convey.Convey("Silent peer is closed", func() {
+			select {
+			case <-client.closed:
+				convey.So(client.closeReason, convey.ShouldEqual, NODE_DOWN_TICK_TIMEOUT)
+			case <-time.After(time.Second):
+				convey.So("connection still open", convey.ShouldBeEmpty)
+			}
+			peer.Close()
+		})
+
+		client.Close()
+	})
+}
+
+// 建立一对互相连接的 connection ， setup 在启动读写协程之前调用。
+func startConnPair(agent *Agent, setup func(client, server *connection)) (*connection, *connection) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	convey.So(err, convey.ShouldBeNil)
+	defer listener.Close()
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		tcpConn, _ := listener.AcceptTCP()
+		accepted <- tcpConn
+	}()
+	tcpConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	convey.So(err, convey.ShouldBeNil)
+	client := newConnection(agent, tcpConn)
+	server := newConnection(agent, <-accepted)
+	if setup != nil {
+		setup(client, server)
+	}
+	client.start()
+	server.start()
+	return client, server
+}
+
+func castBody(process *Process, message []byte) []byte {
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint64(uint64(process.GetId())).
+		PushUint64(uint64(len(message))).
+		PushBytes(message)
+	return requestBuf.Bytes()
+}
@@ -0,0 +1,157 @@
+package godist
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// 握手时双方各自生成的随机数的长度。
+const COOKIE_CHALLENGE_SIZE = 32
+
+// 摘要中区分双方角色的标签，一方的摘要不能被用作另一方的回应。
+const (
+	COOKIE_ROLE_CLIENT = "client"
+	COOKIE_ROLE_SERVER = "server"
+)
+
+// 设置节点之间共享的 cookie 。设置之后，建立连接时双方需要证明自己持有同样的
+// cookie ，没有通过验证的连接只能发送握手请求。需要在 Listen 和建立连接之前调用。
+func (a *Agent) SetCookie(cookie string) {
+	a.cookie = []byte(cookie)
+}
+
+// 从文件中读取 cookie ，忽略首尾的空白。文件只能由所有者读写，否则返回
+// ErrCookieFile 。
+func (a *Agent) LoadCookie(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCookieFile, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%w: %s is accessible by others", ErrCookieFile, path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCookieFile, err)
+	}
+	cookie := bytes.TrimSpace(content)
+	if len(cookie) == 0 {
+		return fmt.Errorf("%w: %s is empty", ErrCookieFile, path)
+	}
+	a.cookie = cookie
+	return nil
+}
+
+// 以 cookie 计算角色、双方的 challenge 和节点名的摘要。 clientChallenge 为发起方
+// 的 challenge ， serverChallenge 为接收方的 challenge 。
+func (agent *Agent) cookieDigest(role string, clientChallenge, serverChallenge []byte, name string) []byte {
+	mac := hmac.New(sha256.New, agent.cookie)
+	mac.Write([]byte(role))
+	mac.Write(clientChallenge)
+	mac.Write(serverChallenge)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+func newChallenge() ([]byte, error) {
+	challenge := make([]byte, COOKIE_CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// 发起方与节点 name 交换 challenge ，校验对端持有同样的 cookie ，返回需要放在
+// REQ_CONN 中的摘要。没有设置 cookie 时返回 nil 。
+func (agent *Agent) challenge(conn *connection, name string) ([]byte, error) {
+	if agent.cookie == nil {
+		return nil, nil
+	}
+	challenge, err := newChallenge()
+	if err != nil {
+		return nil, err
+	}
+	answer, err := conn.request(REQ_CHALLENGE, challenge)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) != 1+COOKIE_CHALLENGE_SIZE+sha256.Size || answer[0] != ACK_CHALLENGE_OK {
+		log.Printf("godist.cookie node %s refused challenge", name)
+		return nil, ErrAuthFailed
+	}
+	peerChallenge, peerDigest := answer[1:1+COOKIE_CHALLENGE_SIZE], answer[1+COOKIE_CHALLENGE_SIZE:]
+	if !hmac.Equal(peerDigest, agent.cookieDigest(COOKIE_ROLE_SERVER, challenge, peerChallenge, name)) {
+		log.Printf("godist.cookie node %s cookie mismatch", name)
+		return nil, ErrAuthFailed
+	}
+	atomic.StoreInt32(&conn.authenticated, 1)
+	return agent.cookieDigest(COOKIE_ROLE_CLIENT, challenge, peerChallenge, agent.Name()), nil
+}
+
+// Challenge message described
+// +-----------------------+
+// | challenge             |
+// |-----------------------|
+// | COOKIE_CHALLENGE_SIZE |
+// +-----------------------+
+//
+// Answer message described
+// +-----------------------------------------------+
+// | result | challenge             | digest      |
+// |--------|-----------------------|-------------|
+// | 1      | COOKIE_CHALLENGE_SIZE | sha256.Size |
+// +-----------------------------------------------+
+//
+// digest 为以 cookie 计算的 COOKIE_ROLE_SERVER 、双方的 challenge 与本节点名的
+// HMAC-SHA256 。发起方在 REQ_CONN 中以 COOKIE_ROLE_CLIENT 和自己的节点名回应。
+// 每条连接只能发送一次 REQ_CHALLENGE 。没有设置 cookie 时只应答
+// ACK_CONN_AUTH_FAILED 。
+func (agent *Agent) handleChallenge(conn *connection, request []byte) ([]byte, error) {
+	if agent.cookie == nil || len(request) != COOKIE_CHALLENGE_SIZE || conn.peerChallenge != nil {
+		return []byte{ACK_CONN_AUTH_FAILED}, nil
+	}
+	challenge, err := newChallenge()
+	if err != nil {
+		return nil, err
+	}
+	conn.challenge, conn.peerChallenge = challenge, request
+	answer := append([]byte{ACK_CHALLENGE_OK}, challenge...)
+	return append(answer, agent.cookieDigest(COOKIE_ROLE_SERVER, request, challenge, agent.Name())...), nil
+}
+
+// 校验接入方对本节点 challenge 的回应。每个 challenge 只能使用一次。没有设置
+// cookie 时不做校验。
+func (agent *Agent) verifyCookie(conn *connection, name string, digest []byte) error {
+	if agent.cookie == nil {
+		return nil
+	}
+	challenge := conn.challenge
+	conn.challenge = nil
+	if challenge == nil {
+		return fmt.Errorf("%w: no challenge", ErrAuthFailed)
+	}
+	if !hmac.Equal(digest, agent.cookieDigest(COOKIE_ROLE_CLIENT, conn.peerChallenge, challenge, name)) {
+		return fmt.Errorf("%w: cookie mismatch", ErrAuthFailed)
+	}
+	return nil
+}
+
+// 设置了 cookie 或者 TLS 时，没有通过验证的连接只能发送握手请求。
+func (agent *Agent) requestAllowed(conn *connection, code byte) bool {
+	return code == REQ_CHALLENGE || code == REQ_CONN || agent.verified(conn)
+}
+
+// 连接是否通过了验证。没有设置 cookie 和 TLS 时不需要验证；接入的连接在 REQ_CONN
+// 成功之后才算通过验证。
+func (agent *Agent) verified(conn *connection) bool {
+	if agent.cookie == nil && agent.tlsConfig == nil {
+		return true
+	}
+	return atomic.LoadInt32(&conn.authenticated) == 1
+}
@@ -0,0 +1,167 @@
+package godist
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestCookie(t *testing.T) {
+	convey.Convey("Cookie", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgentsWith(gpmdPort, func(agent *Agent) {
+			agent.SetCookie("secret")
+		}, "cookie_a", "cookie_b")
+		a, b := agents[0], agents[1]
+
+		start := func(name, cookie string) *Agent {
+			agent := New(name + "@localhost")
+			agent.SetGPMD("localhost", gpmdPort)
+			if cookie != "" {
+				agent.SetCookie(cookie)
+			}
+			agent.Listen()
+			agent.Register()
+			go agent.Serve()
+			agent.QueryNode(b.Node().FullName())
+			return agent
+		}
+
+		convey.Convey("Same cookie", func() {
+			process := b.NewProcess()
+			convey.So(a.Send(process.Pid(), []byte("hello")), convey.ShouldBeNil)
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("hello"))
+		})
+
+		convey.Convey("Wrong cookie", func() {
+			evil := start("cookie_evil", "guess")
+			convey.So(evil.ConnectTo(b.Name()), convey.ShouldEqual, ErrAuthFailed)
+			convey.So(b.connExist(evil.Name()), convey.ShouldBeFalse)
+			stopAgents([]*Agent{evil})
+		})
+
+		convey.Convey("Without cookie", func() {
+			plain := start("cookie_plain", "")
+			convey.So(plain.ConnectTo(b.Name()), convey.ShouldEqual, ErrAuthFailed)
+			convey.So(b.connExist(plain.Name()), convey.ShouldBeFalse)
+			stopAgents([]*Agent{plain})
+		})
+
+		convey.Convey("Requests before handshake", func() {
+			address := fmt.Sprintf("%s:%d", b.Host(), b.Port())
+			tcpAddr, _ := net.ResolveTCPAddr("tcp", address)
+			tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+			convey.So(err, convey.ShouldBeNil)
+			client := newConnection(New("cookie_raw@localhost"), tcpConn)
+			client.start()
+			process := b.NewProcess()
+			_, err = client.request(REQ_CAST, castBody(process, []byte("inject")))
+			convey.So(err, convey.ShouldEqual, ErrConnectionClosed)
+			convey.So(process.Channel, convey.ShouldBeEmpty)
+		})
+
+		convey.Convey("Chunks before handshake", func() {
+			address := fmt.Sprintf("%s:%d", b.Host(), b.Port())
+			tcpAddr, _ := net.ResolveTCPAddr("tcp", address)
+			tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+			convey.So(err, convey.ShouldBeNil)
+			client := newConnection(New("cookie_raw@localhost"), tcpConn)
+			client.start()
+			client.write(packFrame(FRAME_CHUNK, 1, append([]byte{FRAME_REQUEST, 0}, make([]byte, 1024)...)))
+			select {
+			case <-client.closed:
+			case <-time.After(time.Second):
+				convey.So("connection still open", convey.ShouldBeEmpty)
+			}
+		})
+
+		convey.Convey("Reflected digest", func() {
+			address := fmt.Sprintf("%s:%d", b.Host(), b.Port())
+			tcpAddr, _ := net.ResolveTCPAddr("tcp", address)
+			tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+			convey.So(err, convey.ShouldBeNil)
+			raw := New("cookie_mirror@localhost")
+			raw.SetCookie("secret")
+			client := newConnection(raw, tcpConn)
+			client.start()
+			challenge, _ := newChallenge()
+			answer, err := client.request(REQ_CHALLENGE, challenge)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer[0], convey.ShouldEqual, ACK_CHALLENGE_OK)
+			peerChallenge, peerDigest := answer[1:1+COOKIE_CHALLENGE_SIZE], answer[1+COOKIE_CHALLENGE_SIZE:]
+
+			// 每条连接只能交换一次 challenge 。
+			answer, err = client.request(REQ_CHALLENGE, challenge)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_CONN_AUTH_FAILED})
+
+			// 即使摘要正确，也不能声明为对端自己的名字。
+			digest := raw.cookieDigest(COOKIE_ROLE_CLIENT, challenge, peerChallenge, b.Name())
+			answer, err = client.request(REQ_CONN, cookieConnectRequest(b.Name(), digest))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_CONN_AUTH_FAILED})
+
+			// 对端作为接收方的摘要不能用作发起方的回应。
+			answer, err = client.request(REQ_CONN, cookieConnectRequest(raw.Name(), peerDigest))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(answer, convey.ShouldResemble, []byte{ACK_CONN_AUTH_FAILED})
+			convey.So(b.connExist(raw.Name()), convey.ShouldBeFalse)
+			client.Close()
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
+
+// 节点 name 带有 cookie 摘要 digest 的 REQ_CONN 。
+func cookieConnectRequest(name string, digest []byte) []byte {
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushByte(ACK_CONN_IS_NOT_RETURN).
+		PushUint16(9999).
+		PushUint16(uint16(len(name))).
+		PushString(name).
+		PushUint16(uint16(len("localhost"))).
+		PushString("localhost").
+		PushByte(0).
+		PushByte(byte(len(digest))).
+		PushBytes(digest).
+		PushUint16(PROTOCOL_VERSION).
+		PushUint64(CAPABILITIES).
+		PushUint32(1)
+	return requestBuf.Bytes()
+}
+
+func TestLoadCookie(t *testing.T) {
+	convey.Convey("Load cookie", t, func() {
+		agent := New("cookie_file@localhost")
+		path := filepath.Join(t.TempDir(), "cookie")
+
+		convey.So(os.WriteFile(path, []byte("secret\n"), 0600), convey.ShouldBeNil)
+		convey.So(agent.LoadCookie(path), convey.ShouldBeNil)
+		convey.So(agent.cookie, convey.ShouldResemble, []byte("secret"))
+
+		convey.So(os.Chmod(path, 0644), convey.ShouldBeNil)
+		convey.So(agent.LoadCookie(path), convey.ShouldWrap, ErrCookieFile)
+
+		convey.So(os.WriteFile(path, []byte(" \n"), 0600), convey.ShouldBeNil)
+		convey.So(os.Chmod(path, 0600), convey.ShouldBeNil)
+		convey.So(agent.LoadCookie(path), convey.ShouldWrap, ErrCookieFile)
+
+		convey.So(agent.LoadCookie(path+".missing"), convey.ShouldWrap, ErrCookieFile)
+	})
+}
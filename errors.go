@@ -0,0 +1,70 @@
+package godist
+
+import "errors"
+
+var (
+	// 无法连接 GPMD 或者与 GPMD 通信失败。
+	ErrGPMDUnreachable = errors.New("godist: GPMD unreachable")
+	// 同名节点已经在 GPMD 中注册。
+	ErrRegisterConflict = errors.New("godist: node already registered")
+	// 没有可以监听的端口。
+	ErrListenFailed = errors.New("godist: listen failed")
+	// 节点信息未知，需要先 QueryNode 。
+	ErrNodeUnknown = errors.New("godist: node unknown")
+	// 无法与目标节点建立连接。
+	ErrNodeUnreachable = errors.New("godist: node unreachable")
+	// 目标节点没有建立连接。
+	ErrNotConnected = errors.New("godist: node not connected")
+	// 正在重连的节点的待发送队列已满。
+	ErrOutboxFull = errors.New("godist: outbox full")
+	// 连接已经关闭，请求没有得到应答。
+	ErrConnectionClosed = errors.New("godist: connection closed")
+	// 目标 Routine 不存在。
+	ErrRoutineNotFound = errors.New("godist: routine not found")
+	// 名字已经被注册，或者 Goroutine 已经注册过名字。
+	ErrNameRegistered = errors.New("godist: name already registered")
+	// 名字没有注册。
+	ErrNameNotFound = errors.New("godist: name not found")
+	// Pid 不属于本节点。
+	ErrNotLocal = errors.New("godist: pid is not local")
+	// Goroutine 不是进程组的成员。
+	ErrNotMember = errors.New("godist: not a group member")
+	// Pid 属于目标节点之前的运行实例。
+	ErrStalePid = errors.New("godist: stale pid")
+	// Process 已经退出。
+	ErrProcessExited = errors.New("godist: process exited")
+	// 目标 Goroutine 的信箱已满，消息被拒绝。
+	ErrMailboxFull = errors.New("godist: mailbox full")
+	// 目标 Routine 不接受 Call 请求。
+	ErrCallRejected = errors.New("godist: routine does not accept call")
+	// Call 的调用方已经超时或取消，回复被丢弃。
+	ErrCallExpired = errors.New("godist: call expired")
+	// Codec Id 已经被注册。
+	ErrCodecRegistered = errors.New("godist: codec already registered")
+	// Codec Id 没有注册。
+	ErrCodecNotFound = errors.New("godist: codec not found")
+	// 编码或者解码失败。
+	ErrCodecFailed = errors.New("godist: codec failed")
+	// 没有注册对应名字的 SpawnFactory 。
+	ErrSpawnableNotFound = errors.New("godist: spawnable not found")
+	// SpawnFactory 返回了错误。
+	ErrSpawnFailed = errors.New("godist: spawn failed")
+	// 没有注册对应的 RPC 函数。
+	ErrFuncNotFound = errors.New("godist: rpc function not found")
+	// RPC 函数返回了错误或者 panic 。
+	ErrRPCFailed = errors.New("godist: rpc failed")
+	// 请求或者应答超过了最大长度。
+	ErrMessageTooLarge = errors.New("godist: message too large")
+	// 对端的证书与其节点名不一致。
+	ErrIdentityMismatch = errors.New("godist: peer certificate does not match node name")
+	// 对端没有通过 cookie 验证，或者拒绝了本节点的连接。
+	ErrAuthFailed = errors.New("godist: authentication failed")
+	// cookie 文件无法读取、为空或者权限过于宽松。
+	ErrCookieFile = errors.New("godist: bad cookie file")
+	// 对端不支持该功能。
+	ErrNotSupported = errors.New("godist: not supported by peer")
+	// 无法识别的帧。
+	ErrBadFrame = errors.New("godist: bad frame")
+	// 对端返回了无法识别的应答。
+	ErrBadAnswer = errors.New("godist: bad answer")
+)
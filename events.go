@@ -0,0 +1,72 @@
+package godist
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// 节点事件类型。
+type NodeEventKind uint8
+
+const (
+	NODE_UP NodeEventKind = iota + 1
+	NODE_DOWN
+)
+
+func (kind NodeEventKind) String() string {
+	switch kind {
+	case NODE_UP:
+		return "nodeup"
+	case NODE_DOWN:
+		return "nodedown"
+	}
+	return "unknown"
+}
+
+// 节点断开的原因。读写出错时原因为对应的错误信息。
+const (
+	NODE_DOWN_CLOSED       = "closed"
+	NODE_DOWN_PEER_CLOSED  = "peer closed"
+	NODE_DOWN_TICK_TIMEOUT = "heartbeat timeout"
+	NODE_DOWN_RESTARTED    = "restarted"
+)
+
+// 节点上下线事件。到节点的连接握手完成时产生 NODE_UP ，连接断开时产生
+// NODE_DOWN ， Reason 为断开原因。对端重启之后的连接替换旧的连接时，先产生原因为
+// NODE_DOWN_RESTARTED 的 NODE_DOWN ，再产生 NODE_UP 。
+type NodeEvent struct {
+	Kind   NodeEventKind
+	Node   string
+	Reason string
+}
+
+// 订阅节点上下线事件。调用 cancel 取消订阅并关闭事件通道。订阅方处理不及时导致
+// 通道写满时，新的事件会被丢弃。
+func (agent *Agent) SubscribeNodeEvents() (events <-chan NodeEvent, cancel func()) {
+	id := atomic.AddUint64(&agent.eventCounter, 1)
+	eventChan := make(chan NodeEvent, 100)
+	agent.eventLock.Lock()
+	agent.nodeEvents[id] = eventChan
+	agent.eventLock.Unlock()
+	cancel = func() {
+		agent.eventLock.Lock()
+		defer agent.eventLock.Unlock()
+		if _, exist := agent.nodeEvents[id]; exist {
+			delete(agent.nodeEvents, id)
+			close(eventChan)
+		}
+	}
+	return eventChan, cancel
+}
+
+func (agent *Agent) publishNodeEvent(event NodeEvent) {
+	agent.eventLock.RLock()
+	defer agent.eventLock.RUnlock()
+	for _, eventChan := range agent.nodeEvents {
+		select {
+		case eventChan <- event:
+		default:
+			log.Printf("godist: drop %s event of node %s", event.Kind, event.Node)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package godist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func receiveNodeEvent(events <-chan NodeEvent) NodeEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		return NodeEvent{}
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	convey.Convey("Node events", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		a := startAgents(gpmdPort, "events_a")[0]
+		b := startAgents(gpmdPort, "events_b")[0]
+		events, cancel := a.SubscribeNodeEvents()
+
+		convey.So(a.QueryNode(b.Node().FullName()), convey.ShouldBeNil)
+		convey.So(a.ConnectTo(b.Name()), convey.ShouldBeNil)
+		convey.So(receiveNodeEvent(events), convey.ShouldResemble, NodeEvent{
+			Kind: NODE_UP,
+			Node: b.Name(),
+		})
+
+		conn, _ := a.findConn(b.Name())
+		conn.Close()
+		convey.So(receiveNodeEvent(events), convey.ShouldResemble, NodeEvent{
+			Kind:   NODE_DOWN,
+			Node:   b.Name(),
+			Reason: NODE_DOWN_CLOSED,
+		})
+
+		cancel()
+		cancel()
+		_, open := <-events
+		convey.So(open, convey.ShouldBeFalse)
+
+		stopAgents([]*Agent{a, b})
+		m.Stop()
+		m.Stopped()
+	})
+}
@@ -0,0 +1,217 @@
+package godist
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/base"
+)
+
+// GlobalResolver 决定同一个全局名字对应两个不同 Pid 时保留哪一个。网络分区恢复
+// 后各节点分别独立处理冲突，因此集群内所有节点必须使用同样的 resolver ，并且结果
+// 不能依赖参数顺序。
+type GlobalResolver func(name string, a, b base.Pid) base.Pid
+
+// 默认的冲突处理：保留节点名较小的 Pid ，节点名相同时比较 Creation 和 Id 。
+func DefaultGlobalResolver(name string, a, b base.Pid) base.Pid {
+	if pidLess(a, b) {
+		return a
+	}
+	return b
+}
+
+func pidLess(a, b base.Pid) bool {
+	if a.Node != b.Node {
+		return a.Node < b.Node
+	}
+	if a.Creation != b.Creation {
+		return a.Creation < b.Creation
+	}
+	return a.Id < b.Id
+}
+
+// 设置全局名字的冲突处理函数。
+func (agent *Agent) SetGlobalResolver(resolver GlobalResolver) {
+	agent.globalLock.Lock()
+	defer agent.globalLock.Unlock()
+	agent.globalResolver = resolver
+}
+
+// 在整个集群中注册一个名字。名字会广播给所有已连接的节点，之后连接的节点会在建
+// 立连接时同步。名字已经对应其他 Pid 时返回 ErrNameRegistered 。
+//
+// 注册不加集群锁，多个节点同时注册同一个名字时，由 GlobalResolver 决定最终结果。
+func (agent *Agent) RegisterGlobal(name string, pid base.Pid) error {
+	agent.globalLock.Lock()
+	if current, exist := agent.globals[name]; exist {
+		agent.globalLock.Unlock()
+		if current == pid {
+			return nil
+		}
+		return ErrNameRegistered
+	}
+	agent.globals[name] = pid
+	agent.globalLock.Unlock()
+	agent.broadcastGlobal(REQ_GLOBAL_REGISTER, name, pid)
+	return nil
+}
+
+// 在整个集群中注销一个名字。
+func (agent *Agent) UnregisterGlobal(name string) error {
+	agent.globalLock.Lock()
+	pid, exist := agent.globals[name]
+	if !exist {
+		agent.globalLock.Unlock()
+		return ErrNameNotFound
+	}
+	delete(agent.globals, name)
+	agent.globalLock.Unlock()
+	agent.broadcastGlobal(REQ_GLOBAL_UNREGISTER, name, pid)
+	return nil
+}
+
+// 查找全局名字对应的 Pid 。
+func (agent *Agent) WhereIsGlobal(name string) (base.Pid, bool) {
+	agent.globalLock.RLock()
+	defer agent.globalLock.RUnlock()
+	pid, exist := agent.globals[name]
+	return pid, exist
+}
+
+func (agent *Agent) broadcastGlobal(code byte, name string, pid base.Pid) {
+	requestBuf := new(bytes.Buffer)
+	pushPid(binpacker.NewPacker(endian, requestBuf).
+		PushUint16(uint16(len(name))).
+		PushString(name), pid)
+	for _, conn := range agent.allConns() {
+		if !conn.supports(CAP_GLOBAL) {
+			continue
+		}
+		if _, err := conn.request(code, requestBuf.Bytes()); err != nil {
+			log.Printf("godist.global broadcast to %s error: %s", conn.name, err)
+		}
+	}
+}
+
+// 合并一条来自其他节点的注册信息，冲突时交给 resolver 处理。
+func (agent *Agent) mergeGlobal(name string, pid base.Pid) {
+	agent.globalLock.Lock()
+	defer agent.globalLock.Unlock()
+	current, exist := agent.globals[name]
+	if !exist || current == pid {
+		agent.globals[name] = pid
+		return
+	}
+	winner := agent.globalResolver(name, current, pid)
+	log.Printf("godist.global name %s conflict between %s and %s, keep %s", name, current, pid, winner)
+	agent.globals[name] = winner
+}
+
+// 将本节点上的 Goroutine 注册的全局名字同步给新连接的节点。其他节点上的名字由
+// 所在节点负责同步。
+func (agent *Agent) syncGlobals(conn *connection) {
+	agent.globalLock.RLock()
+	var count uint32
+	entriesBuf := new(bytes.Buffer)
+	pk := binpacker.NewPacker(endian, entriesBuf)
+	for name, pid := range agent.globals {
+		if pid.Node != agent.Name() {
+			continue
+		}
+		pushPid(pk.PushUint16(uint16(len(name))).PushString(name), pid)
+		count++
+	}
+	agent.globalLock.RUnlock()
+	if count == 0 {
+		return
+	}
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint32(count).
+		PushBytes(entriesBuf.Bytes())
+	if _, err := conn.request(REQ_GLOBAL_SYNC, requestBuf.Bytes()); err != nil {
+		log.Printf("godist.global sync to %s error: %s", conn.name, err)
+	}
+}
+
+// 节点断开后，移除该节点上的 Goroutine 注册的全局名字。
+func (agent *Agent) releaseGlobals(nodeName string) {
+	agent.globalLock.Lock()
+	defer agent.globalLock.Unlock()
+	for name, pid := range agent.globals {
+		if pid.Node == nodeName {
+			delete(agent.globals, name)
+		}
+	}
+}
+
+// Global register message described
+// +----------------------------------------------------+
+// | name length | name        | pid length | pid        |
+// |-------------|-------------|------------|------------|
+// | 2           | name length | 2          | pid length |
+// +----------------------------------------------------+
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleGlobalRegister(request []byte) ([]byte, error) {
+	name, pid, err := unpackNameAndPid(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+	if err != nil {
+		return nil, err
+	}
+	agent.mergeGlobal(name, pid)
+	return []byte{ACK_GLOBAL_OK}, nil
+}
+
+// 格式同 handleGlobalRegister 。只有名字仍然对应该 Pid 时才会移除。
+func (agent *Agent) handleGlobalUnregister(request []byte) ([]byte, error) {
+	name, pid, err := unpackNameAndPid(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+	if err != nil {
+		return nil, err
+	}
+	agent.globalLock.Lock()
+	defer agent.globalLock.Unlock()
+	if current, exist := agent.globals[name]; exist && current == pid {
+		delete(agent.globals, name)
+	}
+	return []byte{ACK_GLOBAL_OK}, nil
+}
+
+// Global sync message described
+// +------------------------------------------------------------------+
+// | count | name length | name        | pid length | pid        | ... |
+// |-------|-------------|-------------|------------|------------|-----|
+// | 4     | 2           | name length | 2          | pid length | ... |
+// +------------------------------------------------------------------+
+func (agent *Agent) handleGlobalSync(request []byte) ([]byte, error) {
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+	var count uint32
+	if err := unpacker.FetchUint32(&count).Error(); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count; i++ {
+		name, pid, err := unpackNameAndPid(unpacker)
+		if err != nil {
+			return nil, err
+		}
+		agent.mergeGlobal(name, pid)
+	}
+	return []byte{ACK_GLOBAL_OK}, nil
+}
+
+func unpackNameAndPid(unpacker *binpacker.Unpacker) (string, base.Pid, error) {
+	var name string
+	var pid base.Pid
+	if err := unpacker.StringWithUint16Prefix(&name).Error(); err != nil {
+		return "", pid, err
+	}
+	if err := fetchPid(unpacker, &pid); err != nil {
+		return "", pid, err
+	}
+	return name, pid, nil
+}
@@ -0,0 +1,99 @@
+package godist
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestGlobal(t *testing.T) {
+	convey.Convey("Global", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+
+		convey.Convey("Register and unregister", func() {
+			agents := startAgents(gpmdPort, "global_a", "global_b")
+			a, b := agents[0], agents[1]
+			process := a.NewProcess()
+			convey.So(a.RegisterGlobal("svc", process.Pid()), convey.ShouldBeNil)
+			convey.So(a.RegisterGlobal("svc", process.Pid()), convey.ShouldBeNil)
+			convey.So(b.RegisterGlobal("svc", b.Pid(base.RoutineId(1))), convey.ShouldEqual, ErrNameRegistered)
+			pid, exist := b.WhereIsGlobal("svc")
+			convey.So(exist, convey.ShouldBeTrue)
+			convey.So(pid, convey.ShouldResemble, process.Pid())
+			convey.So(b.Send(pid, []byte("ping")), convey.ShouldBeNil)
+			convey.So(<-process.Channel, convey.ShouldResemble, []byte("ping"))
+
+			convey.So(b.UnregisterGlobal("svc"), convey.ShouldBeNil)
+			convey.So(b.UnregisterGlobal("svc"), convey.ShouldEqual, ErrNameNotFound)
+			_, exist = a.WhereIsGlobal("svc")
+			convey.So(exist, convey.ShouldBeFalse)
+			stopAgents(agents)
+		})
+
+		convey.Convey("Sync on join and release on disconnect", func() {
+			agents := startAgents(gpmdPort, "global_c", "global_d")
+			c, d := agents[0], agents[1]
+			convey.So(c.RegisterGlobal("svc", c.Pid(base.RoutineId(1))), convey.ShouldBeNil)
+
+			late := startAgents(gpmdPort, "global_e")[0]
+			convey.So(late.QueryNode(d.Node().FullName()), convey.ShouldBeNil)
+			convey.So(late.ConnectTo(d.Name()), convey.ShouldBeNil)
+			convey.So(late.QueryAllNode(d.Name()), convey.ShouldBeNil)
+			convey.So(waitFor(func() bool {
+				_, exist := late.WhereIsGlobal("svc")
+				return exist
+			}), convey.ShouldBeTrue)
+
+			conn, _ := late.findConn(c.Name())
+			conn.Close()
+			_, exist := late.WhereIsGlobal("svc")
+			convey.So(exist, convey.ShouldBeFalse)
+			_, exist = d.WhereIsGlobal("svc")
+			convey.So(exist, convey.ShouldBeTrue)
+			stopAgents(append(agents, late))
+		})
+
+		convey.Convey("Resolve conflict after netsplit", func() {
+			f := startAgents(gpmdPort, "global_f")[0]
+			g := startAgents(gpmdPort, "global_g")[0]
+			// 保留节点名较大的 Pid 。
+			resolver := func(name string, a, b base.Pid) base.Pid {
+				if a.Node > b.Node {
+					return a
+				}
+				return b
+			}
+			f.SetGlobalResolver(resolver)
+			g.SetGlobalResolver(resolver)
+			convey.So(f.RegisterGlobal("svc", f.Pid(base.RoutineId(1))), convey.ShouldBeNil)
+			convey.So(g.RegisterGlobal("svc", g.Pid(base.RoutineId(1))), convey.ShouldBeNil)
+
+			convey.So(f.QueryNode(g.Node().FullName()), convey.ShouldBeNil)
+			convey.So(f.ConnectTo(g.Name()), convey.ShouldBeNil)
+			winner := g.Pid(base.RoutineId(1))
+			convey.So(waitFor(func() bool {
+				pid, _ := f.WhereIsGlobal("svc")
+				return pid == winner
+			}), convey.ShouldBeTrue)
+			pid, _ := g.WhereIsGlobal("svc")
+			convey.So(pid, convey.ShouldResemble, winner)
+			stopAgents([]*Agent{f, g})
+		})
+
+		convey.Convey("Default resolver", func() {
+			a := base.Pid{Node: "a", Creation: 2, Id: 1}
+			b := base.Pid{Node: "b", Creation: 1, Id: 1}
+			convey.So(DefaultGlobalResolver("svc", a, b), convey.ShouldResemble, a)
+			convey.So(DefaultGlobalResolver("svc", b, a), convey.ShouldResemble, a)
+			older := base.Pid{Node: "a", Creation: 1, Id: 9}
+			convey.So(DefaultGlobalResolver("svc", a, older), convey.ShouldResemble, older)
+		})
+
+		m.Stop()
+		m.Stopped()
+	})
+}
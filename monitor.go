@@ -0,0 +1,508 @@
+package godist
+
+import (
+	"bytes"
+	"log"
+	"sync/atomic"
+
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/base"
+)
+
+// 本节点发起的一次监视。
+type watch struct {
+	watcher base.RoutineId
+	target  base.Pid
+}
+
+// 被监视方登记的一次监视。 ref 由发起方节点分配，因此需要和发起方节点一起区分。
+type monitorKey struct {
+	ref  base.MonitorRef
+	node string
+}
+
+// 监视 target 。 target 退出或者与其所在节点的连接断开时， watcher 会收到一个
+// base.Down 。 target 不存在时会立即收到原因为 REASON_NOPROC 的 Down 。
+func (agent *Agent) Monitor(watcher *base.Routine, target base.Pid) base.MonitorRef {
+	ref := base.MonitorRef(atomic.AddUint64(&agent.monitorCounter, 1))
+	watcherPid := agent.Pid(watcher.GetId())
+	agent.monitorLock.Lock()
+	agent.watching[ref] = watch{
+		watcher: watcher.GetId(),
+		target:  target,
+	}
+	agent.monitorLock.Unlock()
+	if reason, ok := agent.addMonitor(ref, watcherPid, target); !ok {
+		agent.fireDown(ref, target, reason)
+	}
+	return ref
+}
+
+// 取消监视。已经收到 Down 的监视不需要取消。
+func (agent *Agent) Demonitor(ref base.MonitorRef) {
+	agent.monitorLock.Lock()
+	w, exist := agent.watching[ref]
+	delete(agent.watching, ref)
+	agent.monitorLock.Unlock()
+	if exist {
+		agent.removeMonitor(ref, agent.Pid(w.watcher), w.target)
+	}
+}
+
+// 在 routine 和 target 之间建立双向链接。任意一方退出时，另一方会收到
+// base.Exit ；与 target 所在节点的连接断开时，原因为 REASON_NOCONNECTION 。
+func (agent *Agent) Link(routine *base.Routine, target base.Pid) error {
+	self := agent.Pid(routine.GetId())
+	if target == self {
+		return nil
+	}
+	if target.Node == agent.Name() {
+		agent.monitorLock.Lock()
+		defer agent.monitorLock.Unlock()
+		if !agent.routineAlive(target) {
+			return ErrRoutineNotFound
+		}
+		agent.addLink(self.Id, target)
+		agent.addLink(target.Id, self)
+		return nil
+	}
+	conn, exist := agent.findConn(target.Node)
+	if !exist {
+		return ErrNotConnected
+	}
+	// 先在本节点登记，对端在应答之前就可能发来 Exit 。
+	agent.monitorLock.Lock()
+	agent.addLink(self.Id, target)
+	agent.monitorLock.Unlock()
+	err := agent.requestLink(conn, self, target)
+	if err != nil {
+		agent.monitorLock.Lock()
+		agent.removeLink(self.Id, target)
+		agent.monitorLock.Unlock()
+	}
+	return err
+}
+
+func (agent *Agent) requestLink(conn *connection, self base.Pid, target base.Pid) error {
+	requestBuf := new(bytes.Buffer)
+	pushPid(pushPid(binpacker.NewPacker(endian, requestBuf), self), target)
+	answer, err := conn.request(REQ_LINK, requestBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(answer) == 0 {
+		return ErrBadAnswer
+	}
+	switch answer[0] {
+	case ACK_LINK_OK:
+		return nil
+	case ACK_LINK_NOPROC:
+		return ErrRoutineNotFound
+	default:
+		return ErrBadAnswer
+	}
+}
+
+// 解除链接。
+func (agent *Agent) Unlink(routine *base.Routine, target base.Pid) error {
+	self := agent.Pid(routine.GetId())
+	agent.monitorLock.Lock()
+	agent.removeLink(self.Id, target)
+	if target.Node == agent.Name() {
+		agent.removeLink(target.Id, self)
+		agent.monitorLock.Unlock()
+		return nil
+	}
+	agent.monitorLock.Unlock()
+	conn, exist := agent.findConn(target.Node)
+	if !exist {
+		return ErrNotConnected
+	}
+	requestBuf := new(bytes.Buffer)
+	pushPid(pushPid(binpacker.NewPacker(endian, requestBuf), self), target)
+	_, err := conn.request(REQ_UNLINK, requestBuf.Bytes())
+	return err
+}
+
+// 本节点的 Goroutine 是否存活。调用方需要持有 monitorLock ，以便和
+// exitMonitors 互斥。
+func (agent *Agent) routineAlive(pid base.Pid) bool {
+	if pid.Node != agent.Name() || pid.Creation != agent.creation {
+		return false
+	}
+	_, exist := agent.findRoutine(pid.Id)
+	return exist
+}
+
+func (agent *Agent) addLink(routineId base.RoutineId, pid base.Pid) {
+	linked, exist := agent.links[routineId]
+	if !exist {
+		linked = make(map[base.Pid]bool)
+		agent.links[routineId] = linked
+	}
+	linked[pid] = true
+}
+
+func (agent *Agent) removeLink(routineId base.RoutineId, pid base.Pid) {
+	if linked, exist := agent.links[routineId]; exist {
+		delete(linked, pid)
+		if len(linked) == 0 {
+			delete(agent.links, routineId)
+		}
+	}
+}
+
+// 在 target 所在节点登记监视。失败时返回 Down 的原因。
+func (agent *Agent) addMonitor(ref base.MonitorRef, watcher base.Pid, target base.Pid) (string, bool) {
+	if target.Node == agent.Name() {
+		agent.monitorLock.Lock()
+		defer agent.monitorLock.Unlock()
+		if !agent.routineAlive(target) {
+			return base.REASON_NOPROC, false
+		}
+		agent.addMonitorEntry(target.Id, monitorKey{ref, watcher.Node}, watcher)
+		return "", true
+	}
+	conn, exist := agent.findConn(target.Node)
+	if !exist {
+		return base.REASON_NOCONNECTION, false
+	}
+	requestBuf := new(bytes.Buffer)
+	pushPid(pushPid(binpacker.NewPacker(endian, requestBuf).
+		PushUint64(uint64(ref)), watcher), target)
+	answer, err := conn.request(REQ_MONITOR, requestBuf.Bytes())
+	if err != nil {
+		return base.REASON_NOCONNECTION, false
+	}
+	if len(answer) == 0 || answer[0] != ACK_MONITOR_OK {
+		return base.REASON_NOPROC, false
+	}
+	return "", true
+}
+
+func (agent *Agent) addMonitorEntry(routineId base.RoutineId, key monitorKey, watcher base.Pid) {
+	entries, exist := agent.monitors[routineId]
+	if !exist {
+		entries = make(map[monitorKey]base.Pid)
+		agent.monitors[routineId] = entries
+	}
+	entries[key] = watcher
+}
+
+func (agent *Agent) removeMonitorEntry(routineId base.RoutineId, key monitorKey) {
+	if entries, exist := agent.monitors[routineId]; exist {
+		delete(entries, key)
+		if len(entries) == 0 {
+			delete(agent.monitors, routineId)
+		}
+	}
+}
+
+// 在 target 所在节点撤销监视。
+func (agent *Agent) removeMonitor(ref base.MonitorRef, watcher base.Pid, target base.Pid) {
+	if target.Node == agent.Name() {
+		agent.monitorLock.Lock()
+		agent.removeMonitorEntry(target.Id, monitorKey{ref, watcher.Node})
+		agent.monitorLock.Unlock()
+		return
+	}
+	conn, exist := agent.findConn(target.Node)
+	if !exist {
+		return
+	}
+	requestBuf := new(bytes.Buffer)
+	pushPid(pushPid(binpacker.NewPacker(endian, requestBuf).
+		PushUint64(uint64(ref)), watcher), target)
+	if _, err := conn.request(REQ_DEMONITOR, requestBuf.Bytes()); err != nil {
+		log.Printf("godist.monitor demonitor %s error: %s", target, err)
+	}
+}
+
+// 将 Down 交给本节点发起监视的 Goroutine 。监视已经取消时丢弃。
+func (agent *Agent) fireDown(ref base.MonitorRef, target base.Pid, reason string) {
+	agent.monitorLock.Lock()
+	w, exist := agent.watching[ref]
+	delete(agent.watching, ref)
+	agent.monitorLock.Unlock()
+	if !exist {
+		return
+	}
+	if routine, exist := agent.findRoutine(w.watcher); exist {
+		routine.Signal(base.Down{
+			Ref:    ref,
+			Pid:    target,
+			Reason: reason,
+		})
+	}
+}
+
+// 将 Exit 交给本节点的 Goroutine 。
+func (agent *Agent) fireExit(from base.Pid, to base.RoutineId, reason string) {
+	agent.monitorLock.Lock()
+	agent.removeLink(to, from)
+	agent.spawnExited(from, to)
+	agent.monitorLock.Unlock()
+	if routine, exist := agent.findRoutine(to); exist {
+		routine.Signal(base.Exit{
+			From:   from,
+			Reason: reason,
+		})
+	}
+}
+
+// 本节点的 Goroutine 退出，通知所有监视者和链接方，并撤销它发起的监视。
+func (agent *Agent) exitMonitors(routineId base.RoutineId, reason string) {
+	pid := agent.Pid(routineId)
+	agent.monitorLock.Lock()
+	agent.unregisterRoutine(routineId)
+	monitors := agent.monitors[routineId]
+	delete(agent.monitors, routineId)
+	links := agent.links[routineId]
+	delete(agent.links, routineId)
+	watches := make(map[base.MonitorRef]watch)
+	for ref, w := range agent.watching {
+		if w.watcher == routineId {
+			watches[ref] = w
+			delete(agent.watching, ref)
+		}
+	}
+	agent.monitorLock.Unlock()
+
+	for key, watcher := range monitors {
+		agent.sendDown(key.ref, watcher, pid, reason)
+	}
+	for linked := range links {
+		agent.sendExit(pid, linked, reason)
+	}
+	for ref, w := range watches {
+		agent.removeMonitor(ref, pid, w.target)
+	}
+}
+
+func (agent *Agent) sendDown(ref base.MonitorRef, watcher base.Pid, target base.Pid, reason string) {
+	if watcher.Node == agent.Name() {
+		agent.fireDown(ref, target, reason)
+		return
+	}
+	conn, exist := agent.findConn(watcher.Node)
+	if !exist {
+		return
+	}
+	requestBuf := new(bytes.Buffer)
+	pushPid(pushPid(binpacker.NewPacker(endian, requestBuf).
+		PushUint64(uint64(ref)), watcher), target).
+		PushUint16(uint16(len(reason))).
+		PushString(reason)
+	if _, err := conn.request(REQ_DOWN, requestBuf.Bytes()); err != nil {
+		log.Printf("godist.monitor send down to %s error: %s", watcher, err)
+	}
+}
+
+func (agent *Agent) sendExit(from base.Pid, to base.Pid, reason string) {
+	if to.Node == agent.Name() {
+		agent.fireExit(from, to.Id, reason)
+		return
+	}
+	conn, exist := agent.findConn(to.Node)
+	if !exist {
+		return
+	}
+	requestBuf := new(bytes.Buffer)
+	pushPid(pushPid(binpacker.NewPacker(endian, requestBuf), from), to).
+		PushUint16(uint16(len(reason))).
+		PushString(reason)
+	if _, err := conn.request(REQ_EXIT, requestBuf.Bytes()); err != nil {
+		log.Printf("godist.monitor send exit to %s error: %s", to, err)
+	}
+}
+
+// 节点断开后，以 REASON_NOCONNECTION 通知监视和链接了该节点上 Goroutine 的本地
+// Goroutine ，并清理该节点发起的监视。
+func (agent *Agent) releaseMonitors(nodeName string) {
+	agent.monitorLock.Lock()
+	downs := make(map[base.MonitorRef]base.Pid)
+	for ref, w := range agent.watching {
+		if w.target.Node == nodeName {
+			downs[ref] = w.target
+		}
+	}
+	exits := make(map[base.RoutineId][]base.Pid)
+	for routineId, linked := range agent.links {
+		for pid := range linked {
+			if pid.Node == nodeName {
+				exits[routineId] = append(exits[routineId], pid)
+			}
+		}
+	}
+	for routineId, entries := range agent.monitors {
+		for key := range entries {
+			if key.node == nodeName {
+				agent.removeMonitorEntry(routineId, key)
+			}
+		}
+	}
+	agent.monitorLock.Unlock()
+
+	for ref, target := range downs {
+		agent.fireDown(ref, target, base.REASON_NOCONNECTION)
+	}
+	for routineId, pids := range exits {
+		for _, pid := range pids {
+			agent.fireExit(pid, routineId, base.REASON_NOCONNECTION)
+		}
+	}
+}
+
+// Monitor message described
+// +----------------------------------------------------------------+
+// | ref | watcher length | watcher        | target length | target        |
+// |-----|----------------|----------------|---------------|---------------|
+// | 8   | 2              | watcher length | 2             | target length |
+// +----------------------------------------------------------------+
+//
+// watcher 和 target 为 Pid 。
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleMonitor(request []byte) ([]byte, error) {
+	ref, watcher, target, err := unpackMonitor(request)
+	if err != nil {
+		return nil, err
+	}
+	agent.monitorLock.Lock()
+	defer agent.monitorLock.Unlock()
+	if !agent.routineAlive(target) {
+		return []byte{ACK_MONITOR_NOPROC}, nil
+	}
+	agent.addMonitorEntry(target.Id, monitorKey{ref, watcher.Node}, watcher)
+	return []byte{ACK_MONITOR_OK}, nil
+}
+
+// 格式同 handleMonitor 。
+func (agent *Agent) handleDemonitor(request []byte) ([]byte, error) {
+	ref, watcher, target, err := unpackMonitor(request)
+	if err != nil {
+		return nil, err
+	}
+	agent.monitorLock.Lock()
+	agent.removeMonitorEntry(target.Id, monitorKey{ref, watcher.Node})
+	agent.monitorLock.Unlock()
+	return []byte{ACK_MONITOR_OK}, nil
+}
+
+// Down message described
+// +-------------------------------------------------------------+
+// | ref | watcher | target | reason length | reason        |
+// |-----|---------|--------|---------------|---------------|
+// | 8   | pid     | pid    | 2             | reason length |
+// +-------------------------------------------------------------+
+func (agent *Agent) handleDown(request []byte) ([]byte, error) {
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+	ref, _, target, err := fetchMonitor(unpacker)
+	if err != nil {
+		return nil, err
+	}
+	var reason string
+	if err := unpacker.StringWithUint16Prefix(&reason).Error(); err != nil {
+		return nil, err
+	}
+	agent.fireDown(ref, target, reason)
+	return []byte{ACK_MONITOR_OK}, nil
+}
+
+// Link message described
+// +---------------------------------------------------+
+// | from length | from        | to length | to        |
+// |-------------|-------------|-----------|-----------|
+// | 2           | from length | 2         | to length |
+// +---------------------------------------------------+
+//
+// from 为请求方节点的 Pid ， to 为本节点的 Pid 。
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleLink(request []byte) ([]byte, error) {
+	from, to, err := unpackLink(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+	if err != nil {
+		return nil, err
+	}
+	agent.monitorLock.Lock()
+	defer agent.monitorLock.Unlock()
+	if !agent.routineAlive(to) {
+		return []byte{ACK_LINK_NOPROC}, nil
+	}
+	agent.addLink(to.Id, from)
+	return []byte{ACK_LINK_OK}, nil
+}
+
+// 格式同 handleLink 。
+func (agent *Agent) handleUnlink(request []byte) ([]byte, error) {
+	from, to, err := unpackLink(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+	if err != nil {
+		return nil, err
+	}
+	agent.monitorLock.Lock()
+	agent.removeLink(to.Id, from)
+	agent.monitorLock.Unlock()
+	return []byte{ACK_LINK_OK}, nil
+}
+
+// Exit message described
+// +----------------------------------------------+
+// | from | to  | reason length | reason        |
+// |------|-----|---------------|---------------|
+// | pid  | pid | 2             | reason length |
+// +----------------------------------------------+
+func (agent *Agent) handleExit(request []byte) ([]byte, error) {
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+	from, to, err := unpackLink(unpacker)
+	if err != nil {
+		return nil, err
+	}
+	var reason string
+	if err := unpacker.StringWithUint16Prefix(&reason).Error(); err != nil {
+		return nil, err
+	}
+	if to.Node == agent.Name() && to.Creation == agent.creation {
+		agent.fireExit(from, to.Id, reason)
+	}
+	return []byte{ACK_LINK_OK}, nil
+}
+
+func unpackMonitor(request []byte) (base.MonitorRef, base.Pid, base.Pid, error) {
+	return fetchMonitor(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+}
+
+func fetchMonitor(unpacker *binpacker.Unpacker) (base.MonitorRef, base.Pid, base.Pid, error) {
+	var ref uint64
+	var watcher, target base.Pid
+	if err := unpacker.FetchUint64(&ref).Error(); err != nil {
+		return 0, watcher, target, err
+	}
+	if err := fetchPid(unpacker, &watcher); err != nil {
+		return 0, watcher, target, err
+	}
+	if err := fetchPid(unpacker, &target); err != nil {
+		return 0, watcher, target, err
+	}
+	return base.MonitorRef(ref), watcher, target, nil
+}
+
+func unpackLink(unpacker *binpacker.Unpacker) (base.Pid, base.Pid, error) {
+	var from, to base.Pid
+	if err := fetchPid(unpacker, &from); err != nil {
+		return from, to, err
+	}
+	if err := fetchPid(unpacker, &to); err != nil {
+		return from, to, err
+	}
+	return from, to, nil
+}
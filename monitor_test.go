@@ -0,0 +1,160 @@
+package godist
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+// 运行 Process ，收到任意 Cast 消息时以该消息为原因退出。
+func runUntilCast(p *Process) chan bool {
+	done := make(chan bool)
+	go func() {
+		p.Run(func(message []byte) error {
+			return errors.New(string(message))
+		})
+		done <- true
+	}()
+	return done
+}
+
+func receiveSignal(p *Process) base.Signal {
+	select {
+	case signal := <-p.Signals:
+		return signal
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestMonitors(t *testing.T) {
+	convey.Convey("Monitors and links", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgents(gpmdPort, "monitor_a", "monitor_b")
+		a, b := agents[0], agents[1]
+		watcher := a.NewProcess()
+
+		convey.Convey("Local monitor", func() {
+			target := a.NewProcess()
+			done := runUntilCast(target)
+			ref := watcher.Monitor(target.Pid())
+			target.Channel <- []byte("crash")
+			<-done
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Down{
+				Ref:    ref,
+				Pid:    target.Pid(),
+				Reason: "crash",
+			})
+		})
+
+		convey.Convey("Downs beyond the mailbox capacity", func() {
+			small := a.NewProcessWithMailbox(MailboxOptions{Capacity: 1})
+			targets := make([]*Process, 3)
+			for i := range targets {
+				targets[i] = b.NewProcess()
+				small.Monitor(targets[i].Pid())
+			}
+			for _, target := range targets {
+				done := runUntilCast(target)
+				target.Channel <- []byte("crash")
+				<-done
+			}
+			for range targets {
+				down, ok := receiveSignal(small).(base.Down)
+				convey.So(ok, convey.ShouldBeTrue)
+				convey.So(down.Reason, convey.ShouldEqual, "crash")
+			}
+		})
+
+		convey.Convey("Remote monitor", func() {
+			target := b.NewProcess()
+			done := runUntilCast(target)
+			ref := watcher.Monitor(target.Pid())
+			target.Channel <- []byte("crash")
+			<-done
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Down{
+				Ref:    ref,
+				Pid:    target.Pid(),
+				Reason: "crash",
+			})
+		})
+
+		convey.Convey("Monitor unknown routine", func() {
+			missing := b.Pid(base.RoutineId(9898))
+			ref := watcher.Monitor(missing)
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Down{
+				Ref:    ref,
+				Pid:    missing,
+				Reason: base.REASON_NOPROC,
+			})
+		})
+
+		convey.Convey("Demonitor", func() {
+			target := b.NewProcess()
+			done := runUntilCast(target)
+			ref := watcher.Monitor(target.Pid())
+			watcher.Demonitor(ref)
+			target.Channel <- []byte("crash")
+			<-done
+			convey.So(receiveSignal(watcher), convey.ShouldBeNil)
+		})
+
+		convey.Convey("Down on disconnect", func() {
+			target := b.NewProcess()
+			ref := watcher.Monitor(target.Pid())
+			conn, _ := a.findConn(b.Name())
+			conn.Close()
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Down{
+				Ref:    ref,
+				Pid:    target.Pid(),
+				Reason: base.REASON_NOCONNECTION,
+			})
+		})
+
+		convey.Convey("Link propagates exit", func() {
+			target := b.NewProcess()
+			targetDone := runUntilCast(target)
+			watcherDone := runUntilCast(watcher)
+			convey.So(watcher.Link(target.Pid()), convey.ShouldBeNil)
+			target.Channel <- []byte("crash")
+			<-targetDone
+			select {
+			case <-watcherDone:
+			case <-time.After(time.Second):
+				convey.So("linked process still running", convey.ShouldBeEmpty)
+			}
+		})
+
+		convey.Convey("Trap exit", func() {
+			target := b.NewProcess()
+			done := runUntilCast(target)
+			watcher.TrapExit(true)
+			convey.So(watcher.Link(target.Pid()), convey.ShouldBeNil)
+			target.Channel <- []byte("crash")
+			<-done
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Exit{
+				From:   target.Pid(),
+				Reason: "crash",
+			})
+		})
+
+		convey.Convey("Link unknown routine", func() {
+			convey.So(watcher.Link(b.Pid(base.RoutineId(9898))), convey.ShouldEqual, ErrRoutineNotFound)
+			convey.So(watcher.Link(a.Pid(base.RoutineId(9898))), convey.ShouldEqual, ErrRoutineNotFound)
+			a.monitorLock.RLock()
+			_, linked := a.links[watcher.GetId()]
+			a.monitorLock.RUnlock()
+			convey.So(linked, convey.ShouldBeFalse)
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
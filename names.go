@@ -0,0 +1,106 @@
+package godist
+
+import (
+	"bytes"
+
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/base"
+)
+
+// 为本节点的 Goroutine 注册一个名字，其他节点可以通过 CastToName 按名字发送消息。
+// 每个名字只能对应一个 Goroutine ，每个 Goroutine 也只能注册一个名字。
+func (agent *Agent) RegisterName(name string, routine *base.Routine) error {
+	routineId := routine.GetId()
+	if _, exist := agent.findRoutine(routineId); !exist {
+		return ErrRoutineNotFound
+	}
+	agent.nameLock.Lock()
+	defer agent.nameLock.Unlock()
+	if _, exist := agent.names[name]; exist {
+		return ErrNameRegistered
+	}
+	if _, exist := agent.routineNames[routineId]; exist {
+		return ErrNameRegistered
+	}
+	agent.names[name] = routineId
+	agent.routineNames[routineId] = name
+	return nil
+}
+
+// 查找名字对应的 Goroutine 。
+func (agent *Agent) WhereIs(name string) (base.Pid, bool) {
+	agent.nameLock.RLock()
+	defer agent.nameLock.RUnlock()
+	routineId, exist := agent.names[name]
+	if !exist {
+		return base.Pid{}, false
+	}
+	return agent.Pid(routineId), true
+}
+
+// 注销名字。
+func (agent *Agent) UnregisterName(name string) error {
+	agent.nameLock.Lock()
+	defer agent.nameLock.Unlock()
+	routineId, exist := agent.names[name]
+	if !exist {
+		return ErrNameNotFound
+	}
+	delete(agent.names, name)
+	delete(agent.routineNames, routineId)
+	return nil
+}
+
+// 按名字向目标节点上的 Goroutine 发送消息。名字在目标节点上解析。
+func (agent *Agent) CastToName(nodeName string, name string, message []byte) error {
+	if nodeName == agent.Name() {
+		routine, exist := agent.findNamedRoutine(name)
+		if !exist {
+			return ErrNameNotFound
+		}
+		return deliverError(routine.Deliver(message), ErrNameNotFound)
+	}
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint16(uint16(len(name))).
+		PushString(name).
+		PushUint64(uint64(len(message))).
+		PushBytes(message)
+	answer, queued, err := agent.castRequest(nodeName, REQ_CAST_NAME, requestBuf.Bytes(), nil)
+	if err != nil || queued {
+		return err
+	}
+	if len(answer) == 0 {
+		return ErrBadAnswer
+	}
+	switch answer[0] {
+	case ACK_CAST_OK:
+		return nil
+	case ACK_CAST_NAME_NOT_FOUND:
+		return ErrNameNotFound
+	case ACK_CAST_MAILBOX_FULL:
+		return ErrMailboxFull
+	default:
+		return ErrBadAnswer
+	}
+}
+
+func (agent *Agent) findNamedRoutine(name string) (*base.Routine, bool) {
+	agent.nameLock.RLock()
+	routineId, exist := agent.names[name]
+	agent.nameLock.RUnlock()
+	if !exist {
+		return nil, false
+	}
+	return agent.findRoutine(routineId)
+}
+
+// 释放 Goroutine 注册的名字。 Process 退出时调用。
+func (agent *Agent) releaseName(routineId base.RoutineId) {
+	agent.nameLock.Lock()
+	defer agent.nameLock.Unlock()
+	if name, exist := agent.routineNames[routineId]; exist {
+		delete(agent.names, name)
+		delete(agent.routineNames, routineId)
+	}
+}
@@ -0,0 +1,74 @@
+package godist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestNames(t *testing.T) {
+	convey.Convey("Names", t, func() {
+		convey.Convey("Local names", func() {
+			agent := New("names@localhost")
+			process := agent.NewProcess()
+			convey.So(process.RegisterName("worker"), convey.ShouldBeNil)
+			pid, exist := agent.WhereIs("worker")
+			convey.So(exist, convey.ShouldBeTrue)
+			convey.So(pid, convey.ShouldResemble, process.Pid())
+
+			another := agent.NewProcess()
+			convey.So(another.RegisterName("worker"), convey.ShouldEqual, ErrNameRegistered)
+			convey.So(process.RegisterName("worker_2"), convey.ShouldEqual, ErrNameRegistered)
+			orphan := &base.Routine{}
+			orphan.SetId(base.RoutineId(9898))
+			convey.So(agent.RegisterName("orphan", orphan), convey.ShouldEqual, ErrRoutineNotFound)
+
+			convey.So(agent.CastToName(agent.Name(), "worker", []byte("ping")), convey.ShouldBeNil)
+			convey.So(<-process.Channel, convey.ShouldResemble, []byte("ping"))
+			convey.So(agent.CastToName(agent.Name(), "nobody", nil), convey.ShouldEqual, ErrNameNotFound)
+
+			convey.So(agent.UnregisterName("worker"), convey.ShouldBeNil)
+			convey.So(agent.UnregisterName("worker"), convey.ShouldEqual, ErrNameNotFound)
+			_, exist = agent.WhereIs("worker")
+			convey.So(exist, convey.ShouldBeFalse)
+			convey.So(another.RegisterName("worker"), convey.ShouldBeNil)
+		})
+
+		convey.Convey("Released on exit", func() {
+			agent := New("names_2@localhost")
+			process := agent.NewProcess()
+			convey.So(process.RegisterName("worker"), convey.ShouldBeNil)
+			done := make(chan bool)
+			go func() {
+				process.Run(func([]byte) error {
+					return errors.New("stop")
+				})
+				done <- true
+			}()
+			process.Channel <- []byte("stop")
+			<-done
+			_, exist := agent.WhereIs("worker")
+			convey.So(exist, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Remote names", func() {
+			var gpmdPort uint16 = 1989
+			m := gpmd.New("localhost", gpmdPort)
+			m.Serve()
+			agents := startAgents(gpmdPort, "names_a", "names_b")
+			a, b := agents[0], agents[1]
+			process := b.NewProcess()
+			convey.So(process.RegisterName("worker"), convey.ShouldBeNil)
+			convey.So(a.CastToName(b.Name(), "worker", []byte("ping")), convey.ShouldBeNil)
+			convey.So(<-process.Channel, convey.ShouldResemble, []byte("ping"))
+			convey.So(a.CastToName(b.Name(), "nobody", nil), convey.ShouldEqual, ErrNameNotFound)
+			convey.So(a.CastToName("nobody", "worker", nil), convey.ShouldEqual, ErrNotConnected)
+			stopAgents(agents)
+			m.Stop()
+			m.Stopped()
+		})
+	})
+}
@@ -0,0 +1,249 @@
+package godist
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/base"
+)
+
+// 将本节点的 Goroutine 加入进程组。组成员会复制到所有已连接的节点，之后连接的节
+// 点在建立连接时同步。只能加入本节点的 Pid 。
+func (agent *Agent) Join(group string, pid base.Pid) error {
+	if err := agent.checkLocalPid(pid); err != nil {
+		return err
+	}
+	if !agent.addMember(group, pid) {
+		return nil
+	}
+	agent.broadcastGroup(REQ_PG_JOIN, group, pid)
+	return nil
+}
+
+// 将本节点的 Goroutine 移出进程组。
+func (agent *Agent) Leave(group string, pid base.Pid) error {
+	if err := agent.checkLocalPid(pid); err != nil {
+		return err
+	}
+	if !agent.removeMember(group, pid) {
+		return ErrNotMember
+	}
+	agent.broadcastGroup(REQ_PG_LEAVE, group, pid)
+	return nil
+}
+
+// 返回进程组在整个集群中的成员。
+func (agent *Agent) Members(group string) []base.Pid {
+	return agent.members(group, func(base.Pid) bool { return true })
+}
+
+// 返回进程组在本节点上的成员。
+func (agent *Agent) LocalMembers(group string) []base.Pid {
+	return agent.members(group, func(pid base.Pid) bool {
+		return pid.Node == agent.Name()
+	})
+}
+
+// 向进程组的所有成员发送消息。返回所有发送失败的错误。
+func (agent *Agent) Broadcast(group string, message []byte) error {
+	var errs []error
+	for _, pid := range agent.Members(group) {
+		if err := agent.Send(pid, message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (agent *Agent) checkLocalPid(pid base.Pid) error {
+	if pid.Node != agent.Name() {
+		return ErrNotLocal
+	}
+	if pid.Creation != agent.creation {
+		return ErrStalePid
+	}
+	if _, exist := agent.findRoutine(pid.Id); !exist {
+		return ErrRoutineNotFound
+	}
+	return nil
+}
+
+func (agent *Agent) members(group string, filter func(base.Pid) bool) []base.Pid {
+	agent.groupLock.RLock()
+	defer agent.groupLock.RUnlock()
+	pids := make([]base.Pid, 0, len(agent.groups[group]))
+	for pid := range agent.groups[group] {
+		if filter(pid) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Slice(pids, func(i, j int) bool {
+		return pidLess(pids[i], pids[j])
+	})
+	return pids
+}
+
+func (agent *Agent) addMember(group string, pid base.Pid) bool {
+	agent.groupLock.Lock()
+	defer agent.groupLock.Unlock()
+	members, exist := agent.groups[group]
+	if !exist {
+		members = make(map[base.Pid]bool)
+		agent.groups[group] = members
+	}
+	if members[pid] {
+		return false
+	}
+	members[pid] = true
+	return true
+}
+
+func (agent *Agent) removeMember(group string, pid base.Pid) bool {
+	agent.groupLock.Lock()
+	defer agent.groupLock.Unlock()
+	members, exist := agent.groups[group]
+	if !exist || !members[pid] {
+		return false
+	}
+	delete(members, pid)
+	if len(members) == 0 {
+		delete(agent.groups, group)
+	}
+	return true
+}
+
+// 移除满足条件的成员，返回被移除的 (group, pid) 。
+func (agent *Agent) removeMembers(match func(base.Pid) bool) map[base.Pid][]string {
+	agent.groupLock.Lock()
+	defer agent.groupLock.Unlock()
+	removed := make(map[base.Pid][]string)
+	for group, members := range agent.groups {
+		for pid := range members {
+			if match(pid) {
+				delete(members, pid)
+				removed[pid] = append(removed[pid], group)
+			}
+		}
+		if len(members) == 0 {
+			delete(agent.groups, group)
+		}
+	}
+	return removed
+}
+
+// Goroutine 退出时离开所有进程组。
+func (agent *Agent) leaveGroups(pid base.Pid) {
+	removed := agent.removeMembers(func(member base.Pid) bool {
+		return member == pid
+	})
+	for _, group := range removed[pid] {
+		agent.broadcastGroup(REQ_PG_LEAVE, group, pid)
+	}
+}
+
+// 节点断开后移除该节点上的成员。
+func (agent *Agent) releaseGroups(nodeName string) {
+	agent.removeMembers(func(pid base.Pid) bool {
+		return pid.Node == nodeName
+	})
+}
+
+func (agent *Agent) broadcastGroup(code byte, group string, pid base.Pid) {
+	requestBuf := new(bytes.Buffer)
+	pushPid(binpacker.NewPacker(endian, requestBuf).
+		PushUint16(uint16(len(group))).
+		PushString(group), pid)
+	for _, conn := range agent.allConns() {
+		if !conn.supports(CAP_PG) {
+			continue
+		}
+		if _, err := conn.request(code, requestBuf.Bytes()); err != nil {
+			log.Printf("godist.pg broadcast to %s error: %s", conn.name, err)
+		}
+	}
+}
+
+// 将本节点的全部成员同步给新连接的节点。
+func (agent *Agent) syncGroups(conn *connection) {
+	agent.groupLock.RLock()
+	var count uint32
+	entriesBuf := new(bytes.Buffer)
+	pk := binpacker.NewPacker(endian, entriesBuf)
+	for group, members := range agent.groups {
+		for pid := range members {
+			if pid.Node != agent.Name() {
+				continue
+			}
+			pushPid(pk.PushUint16(uint16(len(group))).PushString(group), pid)
+			count++
+		}
+	}
+	agent.groupLock.RUnlock()
+	requestBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, requestBuf).
+		PushUint32(count).
+		PushBytes(entriesBuf.Bytes())
+	if _, err := conn.request(REQ_PG_SYNC, requestBuf.Bytes()); err != nil {
+		log.Printf("godist.pg sync to %s error: %s", conn.name, err)
+	}
+}
+
+// Group join message described
+// +-----------------------------------------------------+
+// | group length | group        | pid length | pid        |
+// |--------------|--------------|------------|------------|
+// | 2            | group length | 2          | pid length |
+// +-----------------------------------------------------+
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleGroupJoin(request []byte) ([]byte, error) {
+	group, pid, err := unpackNameAndPid(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+	if err != nil {
+		return nil, err
+	}
+	agent.addMember(group, pid)
+	return []byte{ACK_PG_OK}, nil
+}
+
+// 格式同 handleGroupJoin 。
+func (agent *Agent) handleGroupLeave(request []byte) ([]byte, error) {
+	group, pid, err := unpackNameAndPid(binpacker.NewUnpacker(endian, bytes.NewBuffer(request)))
+	if err != nil {
+		return nil, err
+	}
+	agent.removeMember(group, pid)
+	return []byte{ACK_PG_OK}, nil
+}
+
+// Group sync message described
+// +--------------------------------------------------------------------+
+// | count | group length | group        | pid length | pid        | ... |
+// |-------|--------------|--------------|------------|------------|-----|
+// | 4     | 2            | group length | 2          | pid length | ... |
+// +--------------------------------------------------------------------+
+//
+// 同步的内容是发送方节点上的全部成员，会替换本节点记录的该节点成员。
+func (agent *Agent) handleGroupSync(conn *connection, request []byte) ([]byte, error) {
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+	var count uint32
+	if err := unpacker.FetchUint32(&count).Error(); err != nil {
+		return nil, err
+	}
+	agent.releaseGroups(conn.name)
+	for i := uint32(0); i < count; i++ {
+		group, pid, err := unpackNameAndPid(unpacker)
+		if err != nil {
+			return nil, err
+		}
+		agent.addMember(group, pid)
+	}
+	return []byte{ACK_PG_OK}, nil
+}
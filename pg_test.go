@@ -0,0 +1,81 @@
+package godist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestGroups(t *testing.T) {
+	convey.Convey("Process groups", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgents(gpmdPort, "pg_a", "pg_b")
+		a, b := agents[0], agents[1]
+		workerA := a.NewProcess()
+		workerB := b.NewProcess()
+		convey.So(workerA.Join("room"), convey.ShouldBeNil)
+		convey.So(workerA.Join("room"), convey.ShouldBeNil)
+		convey.So(workerB.Join("room"), convey.ShouldBeNil)
+
+		convey.Convey("Members", func() {
+			members := []base.Pid{workerA.Pid(), workerB.Pid()}
+			convey.So(a.Members("room"), convey.ShouldResemble, members)
+			convey.So(b.Members("room"), convey.ShouldResemble, members)
+			convey.So(a.LocalMembers("room"), convey.ShouldResemble, []base.Pid{workerA.Pid()})
+			convey.So(b.LocalMembers("room"), convey.ShouldResemble, []base.Pid{workerB.Pid()})
+			convey.So(a.Members("nobody"), convey.ShouldBeEmpty)
+			convey.So(a.Join("room", workerB.Pid()), convey.ShouldEqual, ErrNotLocal)
+			convey.So(a.Join("room", a.Pid(base.RoutineId(9898))), convey.ShouldEqual, ErrRoutineNotFound)
+		})
+
+		convey.Convey("Broadcast", func() {
+			convey.So(a.Broadcast("room", []byte("hello")), convey.ShouldBeNil)
+			convey.So(<-workerA.Channel, convey.ShouldResemble, []byte("hello"))
+			convey.So(<-workerB.Channel, convey.ShouldResemble, []byte("hello"))
+		})
+
+		convey.Convey("Leave", func() {
+			convey.So(workerB.Leave("room"), convey.ShouldBeNil)
+			convey.So(workerB.Leave("room"), convey.ShouldEqual, ErrNotMember)
+			convey.So(a.Members("room"), convey.ShouldResemble, []base.Pid{workerA.Pid()})
+		})
+
+		convey.Convey("Leave on exit", func() {
+			done := make(chan bool)
+			go func() {
+				workerB.Run(func([]byte) error {
+					return errors.New("stop")
+				})
+				done <- true
+			}()
+			workerB.Channel <- []byte("stop")
+			<-done
+			convey.So(a.Members("room"), convey.ShouldResemble, []base.Pid{workerA.Pid()})
+			convey.So(b.Members("room"), convey.ShouldResemble, []base.Pid{workerA.Pid()})
+		})
+
+		convey.Convey("Sync on join and release on disconnect", func() {
+			late := startAgents(gpmdPort, "pg_c")[0]
+			convey.So(late.QueryNode(a.Node().FullName()), convey.ShouldBeNil)
+			convey.So(late.ConnectTo(a.Name()), convey.ShouldBeNil)
+			convey.So(late.QueryAllNode(a.Name()), convey.ShouldBeNil)
+			convey.So(waitFor(func() bool {
+				return len(late.Members("room")) == 2
+			}), convey.ShouldBeTrue)
+
+			conn, _ := late.findConn(b.Name())
+			conn.Close()
+			convey.So(late.Members("room"), convey.ShouldResemble, []base.Pid{workerA.Pid()})
+			stopAgents([]*Agent{late})
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
@@ -1,26 +1,83 @@
 package godist
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"runtime/debug"
+	"sync/atomic"
+	"time"
 
 	"github.com/zhuangsirui/godist/base"
 )
 
 type Process struct {
-	Channel chan []byte
-	routine *base.Routine
+	Channel  chan []byte
+	Requests chan *base.Request
+	Signals  chan base.Signal
+	agent    *Agent
+	routine  *base.Routine
+	trapExit int32
+	stop     chan string
+	done     chan bool
+	reason   string
+	saved    []Message
 }
 
+// Handlers 为 Process 各类消息的处理函数。 Call 为 nil 时不处理 Call 请求；
+// Signal 为 nil 时丢弃收到的信号。任一 handler 返回 error 或者 panic 时 Process
+// 退出。 Terminate 可选，在 Process 退出、释放名字和通知监视者之前以退出原因调用。
+type Handlers struct {
+	Cast      func([]byte) error
+	Call      func(*base.Request) error
+	Signal    func(base.Signal) error
+	Terminate func(reason string)
+}
+
+// Process 信箱的设置。 Capacity 为 Channel 的缓冲大小，为 0 时使用
+// DEFAULT_MAILBOX_CAPACITY 。 Overflow 和 Timeout 见 base.OverflowPolicy 。
+type MailboxOptions struct {
+	Capacity int
+	Overflow base.OverflowPolicy
+	Timeout  time.Duration
+	typed    bool
+}
+
+const DEFAULT_MAILBOX_CAPACITY = 100
+
+// 创建一个 Process 。信箱写满时本节点的 Cast 会一直阻塞，来自其他节点的 Cast 直接
+// 返回 ErrMailboxFull ，需要其他处理方式时使用 NewProcessWithMailbox 。
 func (agent *Agent) NewProcess() *Process {
-	c := make(chan []byte, 100) // XXX this will block channel!
+	return agent.NewProcessWithMailbox(MailboxOptions{})
+}
+
+// 使用指定的信箱设置创建一个 Process 。
+func (agent *Agent) NewProcessWithMailbox(options MailboxOptions) *Process {
+	size := options.Capacity
+	if size <= 0 {
+		size = DEFAULT_MAILBOX_CAPACITY
+	}
+	c := make(chan []byte, size)
+	r := make(chan *base.Request, size)
+	s := make(chan base.Signal, size)
 	routine := &base.Routine{
-		Channel: c,
+		Channel:  c,
+		Requests: r,
+		Signals:  s,
+		Overflow: options.Overflow,
+		Timeout:  options.Timeout,
+		Typed:    options.typed,
 	}
 	agent.RegisterRoutine(routine)
 	return &Process{
-		Channel: c,
-		routine: routine,
+		Channel:  c,
+		Requests: r,
+		Signals:  s,
+		agent:    agent,
+		routine:  routine,
+		stop:     make(chan string, 1),
+		done:     make(chan bool),
 	}
 }
 
@@ -28,35 +85,236 @@ func (p *Process) GetId() base.RoutineId {
 	return p.routine.GetId()
 }
 
-func (p *Process) Receive(bytes []byte) (success bool) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("godist: process %d receive message failed: %s", p.GetId(), r)
-			success = false
-		}
-	}()
-	p.Channel <- bytes
-	success = true
-	return
+// 返回 Process 在集群中的 Pid ，可以放在消息中告知对方回复地址。
+func (p *Process) Pid() base.Pid {
+	return p.agent.Pid(p.GetId())
+}
+
+// 为 Process 注册一个本节点内的名字。 Process 退出时名字会被释放。
+func (p *Process) RegisterName(name string) error {
+	return p.agent.RegisterName(name, p.routine)
+}
+
+// 加入进程组。 Process 退出时会自动离开所有进程组。
+func (p *Process) Join(group string) error {
+	return p.agent.Join(group, p.Pid())
+}
+
+// 离开进程组。
+func (p *Process) Leave(group string) error {
+	return p.agent.Leave(group, p.Pid())
+}
+
+// 因为信箱溢出被丢弃的消息数量。
+func (p *Process) Dropped() uint64 {
+	return p.routine.Dropped()
+}
+
+// 因为信箱已满被拒绝的消息数量。
+func (p *Process) Rejected() uint64 {
+	return p.routine.Rejected()
+}
+
+// 以 reason 停止 Process 。 Process 处理完当前消息后退出，只有第一次调用的原因
+// 生效。以 base.REASON_NORMAL 停止时，链接方不会随之退出。
+func (p *Process) Stop(reason string) {
+	select {
+	case p.stop <- reason:
+	default:
+	}
+}
+
+// Process 退出时关闭的通道。
+func (p *Process) Done() <-chan bool {
+	return p.done
+}
+
+// 等待 Process 退出，返回退出原因。
+func (p *Process) Wait() string {
+	<-p.done
+	return p.reason
+}
+
+// 监视 target ，target 退出时收到 base.Down 。
+func (p *Process) Monitor(target base.Pid) base.MonitorRef {
+	return p.agent.Monitor(p.routine, target)
+}
+
+// 取消监视。
+func (p *Process) Demonitor(ref base.MonitorRef) {
+	p.agent.Demonitor(ref)
+}
+
+// 与 target 建立链接。
+func (p *Process) Link(target base.Pid) error {
+	return p.agent.Link(p.routine, target)
+}
+
+// 解除与 target 的链接。
+func (p *Process) Unlink(target base.Pid) error {
+	return p.agent.Unlink(p.routine, target)
+}
+
+// 设置是否捕获退出信号。不捕获时，收到原因不为 REASON_NORMAL 的 base.Exit 会使
+// Process 以同样的原因退出；捕获时 base.Exit 会交给 Signal handler 处理。
+func (p *Process) TrapExit(trap bool) {
+	var value int32
+	if trap {
+		value = 1
+	}
+	atomic.StoreInt32(&p.trapExit, value)
+}
+
+// 按照信箱设置向 Process 投递一条消息。 Process 已经退出或者信箱已满时返回
+// false 。
+func (p *Process) Cast(message []byte) bool {
+	return p.routine.Cast(message)
 }
 
 func (p *Process) Run(handler func([]byte) error) {
-	p.run(handler)
+	p.Serve(Handlers{Cast: handler})
+}
+
+// 同时处理 Cast 消息和 Call 请求。 `callHandler` 需要对收到的请求调用 Reply ，
+// 可以在返回之后异步回复。任一 handler 返回 error 时 Process 退出。
+func (p *Process) RunWithCall(handler func([]byte) error, callHandler func(*base.Request) error) {
+	p.Serve(Handlers{Cast: handler, Call: callHandler})
 }
 
-func (p *Process) run(handler func([]byte) error) {
+// 使用 handlers 处理 Process 收到的消息，直到 Process 退出。 Process 不会自动
+// 重启，需要重启时交给 Supervisor 管理。
+func (p *Process) Serve(handlers Handlers) {
+	if handlers.Call == nil {
+		p.routine.RejectCalls()
+	}
+	reason := p.loop(handlers)
+	if handlers.Terminate != nil {
+		handlers.Terminate(reason)
+	}
+	p.agent.routineExited(p.GetId(), reason)
+	close(p.Channel)
+	if p.Requests != nil {
+		close(p.Requests)
+	}
+	if p.Signals != nil {
+		close(p.Signals)
+	}
+	p.reason = reason
+	close(p.done)
+}
+
+// 处理消息直到某个 handler 返回 error 、收到退出信号或者被 Stop ，返回退出原因。
+func (p *Process) loop(handlers Handlers) (reason string) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("godist: process restart for reason: %s\n%s", err, debug.Stack())
-			p.run(handler)
-		} else {
-			close(p.Channel)
+			log.Printf("godist.process: Process %d panic: %s\n%s", p.GetId(), err, debug.Stack())
+			reason = fmt.Sprintf("panic: %v", err)
 		}
 	}()
+	requests := p.Requests
+	if handlers.Call == nil {
+		requests = nil
+	}
 	for {
-		if err := handler(<-p.Channel); err != nil {
+		var err error
+		if len(p.saved) > 0 {
+			// 先处理 Receive 保存下来的消息。
+			message := p.saved[0]
+			p.saved = p.saved[1:]
+			err = p.dispatch(handlers, message)
+		} else {
+			select {
+			case message := <-p.Channel:
+				err = handlers.Cast(message)
+			case request := <-requests:
+				err = handlers.Call(request)
+			case signal := <-p.Signals:
+				err = p.handleSignal(handlers, signal)
+			case reason := <-p.stop:
+				log.Printf("godist.process: Process %d stopped. reason: %s", p.GetId(), reason)
+				return reason
+			}
+		}
+		if err != nil {
 			log.Printf("godist.process: Process %d exit. reason: %s", p.GetId(), err)
-			break
+			return err.Error()
+		}
+	}
+}
+
+func (p *Process) handleSignal(handlers Handlers, signal base.Signal) error {
+	if exit, ok := signal.(base.Exit); ok && atomic.LoadInt32(&p.trapExit) == 0 {
+		if exit.Reason == base.REASON_NORMAL {
+			return nil
 		}
+		return errors.New(exit.Reason)
 	}
+	if handlers.Signal == nil {
+		return nil
+	}
+	return handlers.Signal(signal)
+}
+
+func (p *Process) dispatch(handlers Handlers, message Message) error {
+	switch {
+	case message.Request != nil:
+		if handlers.Call == nil {
+			log.Printf("godist.process: Process %d drop call request", p.GetId())
+			return nil
+		}
+		return handlers.Call(message.Request)
+	case message.Signal != nil:
+		return p.handleSignal(handlers, message.Signal)
+	}
+	return handlers.Cast(message.Cast)
+}
+
+// Message 为 Process 收到的一条消息，是 Cast 消息、 Call 请求和信号中的一种。
+type Message struct {
+	Cast    []byte
+	Request *base.Request
+	Signal  base.Signal
+}
+
+// 选择性接收一条 match 返回 true 的消息。 match 为 nil 时接收任意消息。
+//
+// 先按到达顺序查找之前保存下来的消息，再等待新消息。不匹配的消息按到达顺序保存，
+// 之后的 Receive 和 Serve 会继续处理。 ctx 结束时返回 ctx.Err() 。只能在 Process
+// 自己的 Goroutine 中调用，例如在 handler 中等待某个回复。
+func (p *Process) Receive(ctx context.Context, match func(Message) bool) (Message, error) {
+	if match == nil {
+		match = func(Message) bool { return true }
+	}
+	for i, message := range p.saved {
+		if match(message) {
+			p.saved = append(p.saved[:i], p.saved[i+1:]...)
+			return message, nil
+		}
+	}
+	for {
+		var message Message
+		var open bool
+		select {
+		case message.Cast, open = <-p.Channel:
+		case message.Request, open = <-p.Requests:
+		case message.Signal, open = <-p.Signals:
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+		if !open {
+			return Message{}, ErrProcessExited
+		}
+		if match(message) {
+			return message, nil
+		}
+		p.saved = append(p.saved, message)
+	}
+}
+
+// 与 Receive 相同，等待 after 之后仍没有匹配的消息时返回
+// context.DeadlineExceeded 。
+func (p *Process) ReceiveAfter(after time.Duration, match func(Message) bool) (Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), after)
+	defer cancel()
+	return p.Receive(ctx, match)
 }
@@ -2,11 +2,15 @@ package godist
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
 )
 
 func TestNewProcess(t *testing.T) {
@@ -16,6 +20,7 @@ func TestNewProcess(t *testing.T) {
 			agent := New(node)
 			process := agent.NewProcess()
 			convey.So(process.GetId(), convey.ShouldEqual, process.routine.GetId())
+			convey.So(process.Pid(), convey.ShouldResemble, agent.Pid(process.GetId()))
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go func() {
@@ -32,26 +37,197 @@ func TestNewProcess(t *testing.T) {
 			wg.Wait()
 		})
 
-		convey.Convey("Process restart", func() {
+		convey.Convey("Process panic", func() {
 			node := "process_2@localhost"
 			agent := New(node)
 			process := agent.NewProcess()
 			convey.So(process.GetId(), convey.ShouldEqual, process.routine.GetId())
-			var wg sync.WaitGroup
-			wg.Add(1)
-			go func() {
-				process.Run(func(message []byte) error {
-					if bytes.Compare(message, []byte("panic")) == 0 {
-						panic("just a panic")
-					} else {
-						wg.Done()
-						return errors.New("stop")
-					}
-				})
-			}()
+			go process.Run(func(message []byte) error {
+				panic("just a panic")
+			})
 			process.Channel <- []byte("panic")
-			process.Channel <- []byte("peace")
-			wg.Wait()
+			convey.So(process.Wait(), convey.ShouldEqual, "panic: just a panic")
+		})
+
+		convey.Convey("Process call", func() {
+			node := "process_3@localhost"
+			agent := New(node)
+			process := agent.NewProcess()
+			go process.RunWithCall(func(message []byte) error {
+				return errors.New("stop")
+			}, func(request *base.Request) error {
+				return request.Reply(append([]byte("re:"), request.Message...))
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			reply, err := agent.CallTo(ctx, agent.Name(), process.GetId(), []byte("ping"))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(reply, convey.ShouldResemble, []byte("re:ping"))
+			_, err = agent.CallTo(ctx, agent.Name(), base.RoutineId(9898), []byte("ping"))
+			convey.So(err, convey.ShouldEqual, ErrRoutineNotFound)
+			process.Channel <- []byte("stop")
+		})
+
+		convey.Convey("Process without call handler", func() {
+			agent := New("process_6@localhost")
+			process := agent.NewProcess()
+			go process.Run(func(message []byte) error {
+				return nil
+			})
+			// Serve 开始之前到达的请求会被接受，直到超时。
+			convey.So(waitFor(func() bool {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				_, err := agent.CallTo(ctx, agent.Name(), process.GetId(), []byte("ping"))
+				return err == ErrCallRejected
+			}), convey.ShouldBeTrue)
+			process.Stop("shutdown")
+			process.Wait()
 		})
+
+		convey.Convey("Process stop", func() {
+			agent := New("process_4@localhost")
+			process := agent.NewProcess()
+			go process.Run(func(message []byte) error {
+				return nil
+			})
+			process.Stop("shutdown")
+			process.Stop("ignored")
+			convey.So(process.Wait(), convey.ShouldEqual, "shutdown")
+			_, exist := agent.findRoutine(process.GetId())
+			convey.So(exist, convey.ShouldBeFalse)
+			convey.So(agent.CastTo(agent.Name(), process.GetId(), []byte("ping")), convey.ShouldEqual, ErrRoutineNotFound)
+			convey.So(process.routine.Cast([]byte("ping")), convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Process exit reason", func() {
+			agent := New("process_5@localhost")
+			process := agent.NewProcess()
+			go process.Run(func(message []byte) error {
+				return errors.New(string(message))
+			})
+			process.Channel <- []byte("bye")
+			<-process.Done()
+			convey.So(process.Wait(), convey.ShouldEqual, "bye")
+		})
+	})
+}
+
+func TestSelectiveReceive(t *testing.T) {
+	convey.Convey("Selective receive", t, func() {
+		agent := New("receive@localhost")
+		process := agent.NewProcess()
+		isReply := func(message Message) bool {
+			return bytes.HasPrefix(message.Cast, []byte("reply"))
+		}
+
+		convey.Convey("Keep order of unmatched messages", func() {
+			process.Cast([]byte("a"))
+			process.Cast([]byte("b"))
+			process.Cast([]byte("reply"))
+			message, err := process.ReceiveAfter(time.Second, isReply)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("reply"))
+			message, _ = process.ReceiveAfter(time.Second, nil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("a"))
+			message, _ = process.ReceiveAfter(time.Second, nil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("b"))
+		})
+
+		convey.Convey("After", func() {
+			process.Cast([]byte("a"))
+			_, err := process.ReceiveAfter(10*time.Millisecond, isReply)
+			convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+		})
+
+		convey.Convey("Serve handles saved messages", func() {
+			received := make(chan string, 4)
+			go process.Run(func(message []byte) error {
+				if string(message) == "start" {
+					reply, err := process.ReceiveAfter(time.Second, isReply)
+					if err != nil {
+						return err
+					}
+					received <- string(reply.Cast)
+					return nil
+				}
+				received <- string(message)
+				return nil
+			})
+			process.Cast([]byte("start"))
+			process.Cast([]byte("a"))
+			process.Cast([]byte("reply"))
+			process.Cast([]byte("b"))
+			for _, expected := range []string{"reply", "a", "b"} {
+				convey.So(<-received, convey.ShouldEqual, expected)
+			}
+			process.Stop(base.REASON_NORMAL)
+			process.Wait()
+			_, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldEqual, ErrProcessExited)
+		})
+	})
+}
+
+func TestMailboxOverflow(t *testing.T) {
+	convey.Convey("Mailbox overflow", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgents(gpmdPort, "mailbox_a", "mailbox_b")
+		a, b := agents[0], agents[1]
+
+		convey.Convey("Reject", func() {
+			process := b.NewProcessWithMailbox(MailboxOptions{
+				Capacity: 1,
+				Overflow: base.OVERFLOW_REJECT,
+			})
+			convey.So(a.Send(process.Pid(), []byte("a")), convey.ShouldBeNil)
+			convey.So(a.Send(process.Pid(), []byte("b")), convey.ShouldEqual, ErrMailboxFull)
+			convey.So(a.CastTo(b.Name(), process.GetId(), []byte("c")), convey.ShouldEqual, ErrMailboxFull)
+			convey.So(b.Send(process.Pid(), []byte("d")), convey.ShouldEqual, ErrMailboxFull)
+			convey.So(process.Rejected(), convey.ShouldEqual, 3)
+		})
+
+		convey.Convey("Drop newest", func() {
+			process := b.NewProcessWithMailbox(MailboxOptions{
+				Capacity: 1,
+				Overflow: base.OVERFLOW_DROP_NEWEST,
+			})
+			convey.So(a.Send(process.Pid(), []byte("a")), convey.ShouldBeNil)
+			convey.So(a.Send(process.Pid(), []byte("b")), convey.ShouldBeNil)
+			convey.So(process.Dropped(), convey.ShouldEqual, 1)
+			convey.So(<-process.Channel, convey.ShouldResemble, []byte("a"))
+		})
+
+		convey.Convey("Full mailbox from network", func() {
+			process := b.NewProcessWithMailbox(MailboxOptions{Capacity: 1})
+			convey.So(a.Send(process.Pid(), []byte("a")), convey.ShouldBeNil)
+			start := time.Now()
+			convey.So(a.Send(process.Pid(), []byte("b")), convey.ShouldEqual, ErrMailboxFull)
+			convey.So(time.Since(start), convey.ShouldBeLessThan, 500*time.Millisecond)
+			// 连接没有被阻塞。
+			other := b.NewProcess()
+			convey.So(a.Send(other.Pid(), []byte("c")), convey.ShouldBeNil)
+			convey.So(<-other.Channel, convey.ShouldResemble, []byte("c"))
+		})
+
+		convey.Convey("Call without handler", func() {
+			process := b.NewProcess()
+			go process.Run(func([]byte) error { return nil })
+			// Serve 开始之前到达的请求会被接受，直到超时。
+			convey.So(waitFor(func() bool {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				_, err := a.CallTo(ctx, b.Name(), process.GetId(), []byte("ping"))
+				return err == ErrCallRejected
+			}), convey.ShouldBeTrue)
+			process.Stop("shutdown")
+			process.Wait()
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
 	})
 }
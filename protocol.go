@@ -0,0 +1,105 @@
+package godist
+
+import "sync/atomic"
+
+// 协议版本。修改线上格式时增加版本号，并为新的功能增加 Capability 。
+const PROTOCOL_VERSION = 2
+
+// 节点支持的功能。建立连接时双方交换各自的 Capability ，只使用双方都支持的功能。
+const (
+	// REQ_CALL 和 REQ_REPLY 。
+	CAP_CALL = 1 << iota
+	// REQ_SEND 和 REQ_CAST_NAME 。
+	CAP_SEND
+	// 全局名字。
+	CAP_GLOBAL
+	// 进程组。
+	CAP_PG
+	// 监视和链接。
+	CAP_MONITOR
+	// 远程启动 Process 。
+	CAP_SPAWN
+	// RPC 调用。
+	CAP_RPC
+	// 心跳帧。
+	CAP_TICK
+	// 分片帧。
+	CAP_CHUNK
+	// 帧压缩。
+	CAP_COMPRESS
+	// 与节点之间只使用一条连接。
+	CAP_SINGLE_CONN
+	// REQ_CAST 和 REQ_SEND 带有 Codec Id 。
+	CAP_CODEC
+)
+
+// 本版本支持的所有功能。
+const CAPABILITIES uint64 = CAP_CALL | CAP_SEND | CAP_GLOBAL | CAP_PG | CAP_MONITOR |
+	CAP_SPAWN | CAP_RPC | CAP_TICK | CAP_CHUNK | CAP_COMPRESS | CAP_SINGLE_CONN | CAP_CODEC
+
+// 握手中没有版本字段的节点是引入版本之前的实现，支持当时已有的所有功能。
+const LEGACY_CAPABILITIES uint64 = CAP_CALL | CAP_SEND | CAP_GLOBAL | CAP_PG | CAP_MONITOR |
+	CAP_SPAWN | CAP_RPC | CAP_TICK | CAP_CHUNK | CAP_COMPRESS
+
+// 限制本节点提供的功能，例如在滚动升级完成之前关闭新的功能。对端发送被关闭的
+// 功能的请求时连接会被关闭。只对之后建立的连接生效。
+func (a *Agent) SetCapabilities(capabilities uint64) {
+	a.capabilities = capabilities & CAPABILITIES
+}
+
+// 返回与 nodeName 节点协商之后的协议版本和双方共同支持的功能。没有连接时返回
+// false 。
+func (agent *Agent) NodeProtocol(nodeName string) (uint16, uint64, bool) {
+	conn, exist := agent.findConn(nodeName)
+	if !exist {
+		return 0, 0, false
+	}
+	return conn.getVersion(), conn.getCapabilities(), true
+}
+
+// 以对端的版本和功能完成协商。握手之前连接按照本节点的功能处理。
+func (c *connection) negotiate(version uint16, capabilities uint64) {
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	c.stateLock.Lock()
+	c.version = version
+	c.stateLock.Unlock()
+	atomic.StoreUint64(&c.capabilities, c.getCapabilities()&capabilities)
+}
+
+// 协商之后的协议版本。
+func (c *connection) getVersion() uint16 {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.version
+}
+
+func (c *connection) getCapabilities() uint64 {
+	return atomic.LoadUint64(&c.capabilities)
+}
+
+func (c *connection) supports(capability uint64) bool {
+	return c.getCapabilities()&capability == capability
+}
+
+// 请求需要的功能。
+func requestCapability(code byte) uint64 {
+	switch code {
+	case REQ_CALL, REQ_REPLY:
+		return CAP_CALL
+	case REQ_SEND, REQ_CAST_NAME:
+		return CAP_SEND
+	case REQ_GLOBAL_REGISTER, REQ_GLOBAL_UNREGISTER, REQ_GLOBAL_SYNC:
+		return CAP_GLOBAL
+	case REQ_PG_JOIN, REQ_PG_LEAVE, REQ_PG_SYNC:
+		return CAP_PG
+	case REQ_MONITOR, REQ_DEMONITOR, REQ_DOWN, REQ_LINK, REQ_UNLINK, REQ_EXIT:
+		return CAP_MONITOR
+	case REQ_SPAWN:
+		return CAP_SPAWN
+	case REQ_RPC:
+		return CAP_RPC
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package godist
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestProtocol(t *testing.T) {
+	convey.Convey("Protocol negotiation", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgentsWith(gpmdPort, func(agent *Agent) {
+			agent.SetCompression(0, DeflateCompressor)
+			if agent.Name() == "protocol_old" {
+				agent.SetCapabilities(CAPABILITIES &^ (CAP_RPC | CAP_COMPRESS))
+			}
+			agent.RegisterFunc("node", "name", func(context.Context, []byte) ([]byte, error) {
+				return []byte(agent.Name()), nil
+			})
+		}, "protocol_a", "protocol_b", "protocol_old")
+		a, b, old := agents[0], agents[1], agents[2]
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		convey.Convey("Same version", func() {
+			version, capabilities, exist := a.NodeProtocol(b.Name())
+			convey.So(exist, convey.ShouldBeTrue)
+			convey.So(version, convey.ShouldEqual, PROTOCOL_VERSION)
+			convey.So(capabilities, convey.ShouldEqual, CAPABILITIES)
+			stats, _ := a.CompressionStats(b.Name())
+			convey.So(stats.Compressor, convey.ShouldEqual, COMPRESS_DEFLATE)
+			_, _, exist = a.NodeProtocol("protocol_none")
+			convey.So(exist, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Common subset", func() {
+			common := CAPABILITIES &^ (CAP_RPC | CAP_COMPRESS)
+			_, capabilities, _ := a.NodeProtocol(old.Name())
+			convey.So(capabilities, convey.ShouldEqual, common)
+			_, capabilities, _ = old.NodeProtocol(a.Name())
+			convey.So(capabilities, convey.ShouldEqual, common)
+
+			_, err := a.RPCCall(ctx, old.Name(), "node", "name", nil)
+			convey.So(err, convey.ShouldEqual, ErrNotSupported)
+			_, err = old.RPCCall(ctx, a.Name(), "node", "name", nil)
+			convey.So(err, convey.ShouldEqual, ErrNotSupported)
+			reply, err := a.RPCCall(ctx, b.Name(), "node", "name", nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(reply), convey.ShouldEqual, b.Name())
+
+			stats, _ := a.CompressionStats(old.Name())
+			convey.So(stats.Compressor, convey.ShouldEqual, COMPRESS_NONE)
+			process := old.NewProcess()
+			convey.So(a.Send(process.Pid(), []byte("hello")), convey.ShouldBeNil)
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("hello"))
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+
+	convey.Convey("Legacy handshake", t, func() {
+		agent := New("protocol_new@localhost")
+		conn := newConnection(agent, nil)
+		// 引入版本之前的 REQ_CONN 没有 version 和 capabilities 。
+		requestBuf := new(bytes.Buffer)
+		binpacker.NewPacker(endian, requestBuf).
+			PushByte(ACK_CONN_IS_RETURN).
+			PushUint16(9999).
+			PushUint16(uint16(len("legacy"))).
+			PushString("legacy").
+			PushUint16(uint16(len("localhost"))).
+			PushString("localhost").
+			PushByte(0).
+			PushByte(0)
+		answer, err := agent.handleConnect(conn, requestBuf.Bytes())
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(answer, convey.ShouldHaveLength, 16)
+		convey.So(answer[0], convey.ShouldEqual, ACK_CONN_OK)
+		// 应答双方协商之后的版本。
+		convey.So(endian.Uint16(answer[2:4]), convey.ShouldEqual, 0)
+		convey.So(conn.getVersion(), convey.ShouldEqual, 0)
+		convey.So(conn.getCapabilities(), convey.ShouldEqual, LEGACY_CAPABILITIES)
+		// 旧的节点另外建立一条连接发送请求，接入的连接不会被登记。
+		convey.So(agent.connExist("legacy"), convey.ShouldBeFalse)
+	})
+
+	convey.Convey("Disabled capability", t, func() {
+		agent := New("protocol_new@localhost")
+		agent.SetCapabilities(CAPABILITIES &^ CAP_RPC)
+		conn := newConnection(agent, nil)
+		_, err := agent.dispatchRequest(conn, 1, REQ_RPC, nil)
+		convey.So(err, convey.ShouldEqual, ErrNotSupported)
+	})
+
+	convey.Convey("Newer peer", t, func() {
+		agent := New("protocol_new@localhost")
+		conn := newConnection(agent, nil)
+		requestBuf := new(bytes.Buffer)
+		binpacker.NewPacker(endian, requestBuf).
+			PushByte(ACK_CONN_IS_RETURN).
+			PushUint16(9999).
+			PushUint16(uint16(len("newer"))).
+			PushString("newer").
+			PushUint16(uint16(len("localhost"))).
+			PushString("localhost").
+			PushByte(0).
+			PushByte(0).
+			PushUint16(PROTOCOL_VERSION + 1).
+			PushUint64(CAPABILITIES &^ CAP_SINGLE_CONN).
+			PushUint32(1)
+		answer, err := agent.handleConnect(conn, requestBuf.Bytes())
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(answer[0], convey.ShouldEqual, ACK_CONN_OK)
+		convey.So(endian.Uint16(answer[2:4]), convey.ShouldEqual, PROTOCOL_VERSION)
+		convey.So(conn.getVersion(), convey.ShouldEqual, PROTOCOL_VERSION)
+	})
+}
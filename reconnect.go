@@ -0,0 +1,174 @@
+package godist
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy 为连接断开之后自动重连的策略。
+//
+// 重连前会重新向对端的 GPMD 查询节点信息，每次失败之后等待时间加倍，并加入随机
+// 抖动，最长不超过 MaxBackoff 。 MinBackoff 和 MaxBackoff 为 0 时分别使用
+// DEFAULT_RECONNECT_MIN_BACKOFF 和 DEFAULT_RECONNECT_MAX_BACKOFF 。 MaxAttempts 为
+// 0 时不限制重连次数。
+//
+// 重连期间发往该节点的 Cast 类消息（ CastTo 、 Send 、 CastToName ）最多排队
+// QueueSize 条，重连成功后按顺序发出，队列已满时返回 ErrOutboxFull ；放弃重连时
+// 队列中的消息被丢弃。 QueueSize 为 0 时直接返回 ErrNotConnected 。
+type ReconnectPolicy struct {
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+	QueueSize   int
+}
+
+const (
+	DEFAULT_RECONNECT_MIN_BACKOFF = 100 * time.Millisecond
+	DEFAULT_RECONNECT_MAX_BACKOFF = 30 * time.Second
+)
+
+// 重连期间排队的请求。
+type outboxEntry struct {
+	code    byte
+	request []byte
+	legacy  []byte
+}
+
+// 设置自动重连策略。默认不自动重连。
+func (agent *Agent) SetReconnectPolicy(policy ReconnectPolicy) {
+	if policy.MinBackoff <= 0 {
+		policy.MinBackoff = DEFAULT_RECONNECT_MIN_BACKOFF
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DEFAULT_RECONNECT_MAX_BACKOFF
+	}
+	if policy.MaxBackoff < policy.MinBackoff {
+		policy.MaxBackoff = policy.MinBackoff
+	}
+	agent.retryPolicy = &policy
+}
+
+// 发送 Cast 类请求。节点正在重连时按照重连策略排队或者拒绝，排队成功时 queued
+// 为 true 。 legacy 不为 nil 时用于不支持 CAP_CODEC 的连接，见 packMessage 。
+func (agent *Agent) castRequest(nodeName string, code byte, request, legacy []byte) (answer []byte, queued bool, err error) {
+	agent.outboxLock.Lock()
+	if entries, reconnecting := agent.outbox[nodeName]; reconnecting {
+		defer agent.outboxLock.Unlock()
+		if agent.retryPolicy.QueueSize == 0 {
+			return nil, false, ErrNotConnected
+		}
+		if len(entries) >= agent.retryPolicy.QueueSize {
+			return nil, false, ErrOutboxFull
+		}
+		agent.outbox[nodeName] = append(entries, outboxEntry{code, request, legacy})
+		return nil, true, nil
+	}
+	agent.outboxLock.Unlock()
+	conn, exist := agent.findConn(nodeName)
+	if !exist {
+		return nil, false, ErrNotConnected
+	}
+	answer, err = conn.request(code, codecRequest(conn, request, legacy))
+	return answer, false, err
+}
+
+func codecRequest(conn *connection, request, legacy []byte) []byte {
+	if legacy != nil && !conn.supports(CAP_CODEC) {
+		return legacy
+	}
+	return request
+}
+
+// 开始在后台重连节点。已经在重连时不做处理。
+func (agent *Agent) startReconnect(name string) {
+	if agent.retryPolicy == nil {
+		return
+	}
+	agent.outboxLock.Lock()
+	defer agent.outboxLock.Unlock()
+	if _, reconnecting := agent.outbox[name]; reconnecting {
+		return
+	}
+	agent.outbox[name] = []outboxEntry{}
+	go agent.reconnect(name, *agent.retryPolicy)
+}
+
+func (agent *Agent) reconnect(name string, policy ReconnectPolicy) {
+	backoff := policy.MinBackoff
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		time.Sleep(jitter(backoff))
+		if agent.isStop.Load() {
+			break
+		}
+		// 对端也可能已经主动连接过来。
+		if agent.connExist(name) && agent.flushOutbox(name) {
+			return
+		}
+		node, exist := agent.findNode(name)
+		if !exist {
+			break
+		}
+		err := agent.queryNode(node.FullName())
+		if err == nil {
+			err = agent.connectTo(node.FullName(), false)
+		}
+		if err == nil {
+			log.Printf("godist.reconnect node %s reconnected after %d attempts", name, attempt)
+			if agent.flushOutbox(name) {
+				return
+			}
+			continue
+		}
+		log.Printf("godist.reconnect node %s attempt %d error: %s", name, attempt, err)
+		if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+	agent.outboxLock.Lock()
+	dropped := len(agent.outbox[name])
+	delete(agent.outbox, name)
+	agent.outboxLock.Unlock()
+	log.Printf("godist.reconnect give up node %s, drop %d messages", name, dropped)
+}
+
+// 按顺序发出排队的请求。发送期间新的请求继续排队，保证先后顺序。连接再次断开时
+// 返回 false ，未发出的请求留在队列中等待下一次重连，发送失败的那条被丢弃。
+func (agent *Agent) flushOutbox(name string) bool {
+	for {
+		agent.outboxLock.Lock()
+		entries := agent.outbox[name]
+		if len(entries) == 0 {
+			delete(agent.outbox, name)
+			agent.outboxLock.Unlock()
+			return true
+		}
+		agent.outbox[name] = []outboxEntry{}
+		agent.outboxLock.Unlock()
+		conn, exist := agent.findConn(name)
+		for i, entry := range entries {
+			var err error
+			if exist {
+				_, err = conn.request(entry.code, codecRequest(conn, entry.request, entry.legacy))
+			} else {
+				err = ErrNotConnected
+			}
+			if err != nil {
+				log.Printf("godist.reconnect flush to %s error: %s", name, err)
+				agent.outboxLock.Lock()
+				agent.outbox[name] = append(entries[i+1:], agent.outbox[name]...)
+				agent.outboxLock.Unlock()
+				return false
+			}
+		}
+	}
+}
+
+// 在 [d/2, d) 之间随机取值。
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
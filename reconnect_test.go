@@ -0,0 +1,103 @@
+package godist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestReconnect(t *testing.T) {
+	convey.Convey("Reconnect", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgents(gpmdPort, "reconnect_a", "reconnect_b")
+		a, b := agents[0], agents[1]
+		worker := b.NewProcess()
+
+		convey.Convey("Queue casts until reconnected", func() {
+			a.SetReconnectPolicy(ReconnectPolicy{
+				MinBackoff: 50 * time.Millisecond,
+				MaxBackoff: 200 * time.Millisecond,
+				QueueSize:  1,
+			})
+			events, cancel := a.SubscribeNodeEvents()
+			defer cancel()
+			conn, _ := a.findConn(b.Name())
+			conn.Close()
+			convey.So(a.Send(worker.Pid(), []byte("first")), convey.ShouldBeNil)
+			convey.So(a.Send(worker.Pid(), []byte("second")), convey.ShouldEqual, ErrOutboxFull)
+			convey.So(receiveNodeEvent(events).Kind, convey.ShouldEqual, NODE_DOWN)
+			convey.So(receiveNodeEvent(events).Kind, convey.ShouldEqual, NODE_UP)
+			select {
+			case message := <-worker.Channel:
+				convey.So(message, convey.ShouldResemble, []byte("first"))
+			case <-time.After(time.Second):
+				convey.So("message not delivered", convey.ShouldBeEmpty)
+			}
+			convey.So(a.Send(worker.Pid(), []byte("third")), convey.ShouldBeNil)
+			convey.So(<-worker.Channel, convey.ShouldResemble, []byte("third"))
+		})
+
+		convey.Convey("Reject casts until reconnected", func() {
+			a.SetReconnectPolicy(ReconnectPolicy{
+				MinBackoff: 50 * time.Millisecond,
+				MaxBackoff: 200 * time.Millisecond,
+			})
+			conn, _ := a.findConn(b.Name())
+			conn.Close()
+			convey.So(a.Send(worker.Pid(), []byte("hello")), convey.ShouldEqual, ErrNotConnected)
+			// 连接登记之后还需要处理完排队的消息才算重连完成。
+			convey.So(waitFor(func() bool {
+				a.outboxLock.Lock()
+				_, reconnecting := a.outbox[b.Name()]
+				a.outboxLock.Unlock()
+				return a.connExist(b.Name()) && !reconnecting
+			}), convey.ShouldBeTrue)
+			convey.So(a.Send(worker.Pid(), []byte("hello")), convey.ShouldBeNil)
+		})
+
+		convey.Convey("Give up", func() {
+			a.SetReconnectPolicy(ReconnectPolicy{
+				MinBackoff:  10 * time.Millisecond,
+				MaxBackoff:  10 * time.Millisecond,
+				MaxAttempts: 2,
+				QueueSize:   10,
+			})
+			b.Stop()
+			b.Stopped()
+			conn, _ := a.findConn(b.Name())
+			conn.Close()
+			convey.So(a.Send(worker.Pid(), []byte("lost")), convey.ShouldBeNil)
+			convey.So(waitFor(func() bool {
+				return a.Send(worker.Pid(), []byte("lost")) == ErrNotConnected
+			}), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("Partial policy", func() {
+			a.SetReconnectPolicy(ReconnectPolicy{QueueSize: 1})
+			convey.So(a.retryPolicy.MinBackoff, convey.ShouldEqual, DEFAULT_RECONNECT_MIN_BACKOFF)
+			convey.So(a.retryPolicy.MaxBackoff, convey.ShouldEqual, DEFAULT_RECONNECT_MAX_BACKOFF)
+			a.SetReconnectPolicy(ReconnectPolicy{MinBackoff: time.Minute})
+			convey.So(a.retryPolicy.MaxBackoff, convey.ShouldEqual, time.Minute)
+
+			a.SetReconnectPolicy(ReconnectPolicy{MaxAttempts: 3})
+			b.Stop()
+			b.Stopped()
+			conn, _ := a.findConn(b.Name())
+			conn.Close()
+			// 每次重连之前至少等待 MinBackoff 的一部分，不会立即用完重连次数。
+			time.Sleep(20 * time.Millisecond)
+			a.outboxLock.Lock()
+			_, reconnecting := a.outbox[b.Name()]
+			a.outboxLock.Unlock()
+			convey.So(reconnecting, convey.ShouldBeTrue)
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
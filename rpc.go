@@ -0,0 +1,217 @@
+package godist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zhuangsirui/binpacker"
+)
+
+// RPCFunc 为可以被其他节点调用的函数。 args 和返回值的编码由调用双方约定，
+// 可以使用 Agent.Encode 和 Agent.Decode 。 ctx 带有调用方的期限，调用方不再等待
+// 之后函数应当尽快返回。
+type RPCFunc func(ctx context.Context, args []byte) ([]byte, error)
+
+// RPC 结果的类型，放在回复的第一个字节。
+const (
+	RPC_RESULT_OK    = 0x00
+	RPC_RESULT_ERROR = 0x01
+)
+
+// MultiCall 中一个节点的调用结果。
+type RPCResult struct {
+	Node  string
+	Reply []byte
+	Err   error
+}
+
+// 以 module 和 function 注册 RPC 函数。已经注册时返回 ErrNameRegistered 。
+func (agent *Agent) RegisterFunc(module, function string, fn RPCFunc) error {
+	key := funcKey(module, function)
+	agent.funcLock.Lock()
+	defer agent.funcLock.Unlock()
+	if _, exist := agent.funcs[key]; exist {
+		return ErrNameRegistered
+	}
+	agent.funcs[key] = fn
+	return nil
+}
+
+// 注销 RPC 函数。
+func (agent *Agent) UnregisterFunc(module, function string) {
+	agent.funcLock.Lock()
+	defer agent.funcLock.Unlock()
+	delete(agent.funcs, funcKey(module, function))
+}
+
+func funcKey(module, function string) string {
+	return module + ":" + function
+}
+
+func (agent *Agent) findFunc(module, function string) (RPCFunc, bool) {
+	agent.funcLock.RLock()
+	defer agent.funcLock.RUnlock()
+	fn, exist := agent.funcs[funcKey(module, function)]
+	return fn, exist
+}
+
+// 在 nodeName 节点上调用 module:function 并等待结果。函数返回的错误以
+// ErrRPCFailed 包装后返回。等待时间由 `ctx` 控制， `ctx` 的剩余期限随请求发送，
+// 对端的函数通过自己的 ctx 得知期限。超时之后函数的结果被丢弃。
+func (agent *Agent) RPCCall(ctx context.Context, nodeName, module, function string, args []byte) ([]byte, error) {
+	callId, replyChan := agent.newCall()
+	defer agent.removeCall(callId)
+	if nodeName == agent.Name() {
+		fn, exist := agent.findFunc(module, function)
+		if !exist {
+			return nil, ErrFuncNotFound
+		}
+		go agent.deliverReply(callId, invokeFunc(ctx, fn, args))
+	} else {
+		conn, exist := agent.findConn(nodeName)
+		if !exist {
+			return nil, ErrNotConnected
+		}
+		var timeout time.Duration
+		if deadline, ok := ctx.Deadline(); ok {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return nil, context.DeadlineExceeded
+			}
+		}
+		requestBuf := new(bytes.Buffer)
+		binpacker.NewPacker(endian, requestBuf).
+			PushUint64(callId).
+			PushUint16(uint16(len(module))).
+			PushString(module).
+			PushUint16(uint16(len(function))).
+			PushString(function).
+			PushUint64(uint64(len(args))).
+			PushBytes(args).
+			PushUint64(uint64(timeout))
+		answer, err := conn.requestContext(ctx, REQ_RPC, requestBuf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if len(answer) == 0 {
+			return nil, ErrBadAnswer
+		}
+		switch answer[0] {
+		case ACK_RPC_OK:
+		case ACK_RPC_NOT_FOUND:
+			return nil, ErrFuncNotFound
+		default:
+			return nil, ErrBadAnswer
+		}
+	}
+	select {
+	case reply := <-replyChan:
+		return parseRPCReply(reply)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 并行地在所有节点上调用 module:function ，按 nodes 的顺序返回每个节点的结果。
+// 所有节点共用 `ctx` 的期限。
+func (agent *Agent) MultiCall(ctx context.Context, nodes []string, module, function string, args []byte) []RPCResult {
+	results := make([]RPCResult, len(nodes))
+	wg := new(sync.WaitGroup)
+	for i, nodeName := range nodes {
+		wg.Add(1)
+		go func(i int, nodeName string) {
+			defer wg.Done()
+			reply, err := agent.RPCCall(ctx, nodeName, module, function, args)
+			results[i] = RPCResult{Node: nodeName, Reply: reply, Err: err}
+		}(i, nodeName)
+	}
+	wg.Wait()
+	return results
+}
+
+// 执行 RPC 函数，将结果编码为回复。 panic 视为函数返回错误。
+func invokeFunc(ctx context.Context, fn RPCFunc, args []byte) (reply []byte) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("godist.rpc: function panic: %v", err)
+			reply = append([]byte{RPC_RESULT_ERROR}, fmt.Sprintf("panic: %v", err)...)
+		}
+	}()
+	result, err := fn(ctx, args)
+	if err != nil {
+		return append([]byte{RPC_RESULT_ERROR}, err.Error()...)
+	}
+	return append([]byte{RPC_RESULT_OK}, result...)
+}
+
+func parseRPCReply(reply []byte) ([]byte, error) {
+	if len(reply) == 0 {
+		return nil, ErrBadAnswer
+	}
+	switch reply[0] {
+	case RPC_RESULT_OK:
+		return reply[1:], nil
+	case RPC_RESULT_ERROR:
+		return nil, fmt.Errorf("%w: %s", ErrRPCFailed, reply[1:])
+	}
+	return nil, ErrBadAnswer
+}
+
+// RPC message described
+// +-----------------------------------------------------------------------------------------------------------------+
+// | call id | module length | module        | function length | function        | args length | args    | timeout |
+// |---------|---------------|---------------|-----------------|-----------------|-------------|---------|---------|
+// | 8       | 2             | module length | 2               | function length | 8           | args    | 8       |
+// +-----------------------------------------------------------------------------------------------------------------+
+//
+// timeout 为调用方剩余的期限，单位为纳秒，为 0 或者没有时表示没有期限。两个节点的
+// 时钟不一定一致，因此发送的是剩余时间而不是截止时间。
+//
+// 函数在新的 Goroutine 中执行，不阻塞连接。结果通过请求到达的连接以 REQ_REPLY
+// 发回，回复的第一个字节为 RPC_RESULT_OK 或者 RPC_RESULT_ERROR ，之后为函数的
+// 返回值或者错误信息。
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleRPC(conn *connection, request []byte) ([]byte, error) {
+	var callId, timeout uint64
+	var module, function string
+	var args []byte
+	requestBuf := bytes.NewBuffer(request)
+	unpacker := binpacker.NewUnpacker(endian, requestBuf)
+	unpacker.FetchUint64(&callId).
+		StringWithUint16Prefix(&module).
+		StringWithUint16Prefix(&function).
+		BytesWithUint64Perfix(&args)
+	if requestBuf.Len() > 0 {
+		unpacker.FetchUint64(&timeout)
+	}
+	if err := unpacker.Error(); err != nil {
+		return nil, err
+	}
+	fn, exist := agent.findFunc(module, function)
+	if !exist {
+		return []byte{ACK_RPC_NOT_FOUND}, nil
+	}
+	go func() {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout))
+			defer cancel()
+		}
+		err := agent.replyTo(context.Background(), conn, callId, invokeFunc(ctx, fn, args))
+		if err != nil && !errors.Is(err, ErrCallExpired) {
+			log.Printf("godist.rpc: reply %s:%s error: %s", module, function, err)
+		}
+	}()
+	return []byte{ACK_RPC_OK}, nil
+}
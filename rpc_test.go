@@ -0,0 +1,109 @@
+package godist
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestRPC(t *testing.T) {
+	convey.Convey("RPC", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgents(gpmdPort, "rpc_a", "rpc_b", "rpc_c")
+		a, b, c := agents[0], agents[1], agents[2]
+		for _, agent := range agents {
+			name := agent.Name()
+			convey.So(agent.RegisterFunc("node", "echo", func(_ context.Context, args []byte) ([]byte, error) {
+				return append([]byte(name+":"), args...), nil
+			}), convey.ShouldBeNil)
+		}
+		convey.So(b.RegisterFunc("node", "echo", nil), convey.ShouldEqual, ErrNameRegistered)
+		convey.So(b.RegisterFunc("node", "fail", func(context.Context, []byte) ([]byte, error) {
+			return nil, errors.New("boom")
+		}), convey.ShouldBeNil)
+		convey.So(b.RegisterFunc("node", "panic", func(context.Context, []byte) ([]byte, error) {
+			panic("boom")
+		}), convey.ShouldBeNil)
+		stopped := make(chan error, 1)
+		convey.So(b.RegisterFunc("node", "sleep", func(ctx context.Context, _ []byte) ([]byte, error) {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-ctx.Done():
+			}
+			stopped <- ctx.Err()
+			return nil, nil
+		}), convey.ShouldBeNil)
+		convey.So(b.RegisterFunc("node", "deadline", func(ctx context.Context, _ []byte) ([]byte, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return nil, errors.New("no deadline")
+			}
+			return []byte(time.Until(deadline).String()), nil
+		}), convey.ShouldBeNil)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		convey.Convey("Call", func() {
+			reply, err := a.RPCCall(ctx, b.Name(), "node", "echo", []byte("hi"))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(reply), convey.ShouldEqual, "rpc_b:hi")
+			reply, err = a.RPCCall(ctx, a.Name(), "node", "echo", []byte("hi"))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(reply), convey.ShouldEqual, "rpc_a:hi")
+
+			_, err = a.RPCCall(ctx, b.Name(), "node", "missing", nil)
+			convey.So(err, convey.ShouldEqual, ErrFuncNotFound)
+			_, err = a.RPCCall(ctx, b.Name(), "node", "fail", nil)
+			convey.So(err, convey.ShouldWrap, ErrRPCFailed)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "boom")
+			_, err = a.RPCCall(ctx, b.Name(), "node", "panic", nil)
+			convey.So(err, convey.ShouldWrap, ErrRPCFailed)
+			_, err = a.RPCCall(ctx, "rpc_none", "node", "echo", nil)
+			convey.So(err, convey.ShouldEqual, ErrNotConnected)
+
+			short, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer shortCancel()
+			_, err = a.RPCCall(short, b.Name(), "node", "sleep", nil)
+			convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+			// 对端的函数收到了同样的期限。
+			convey.So(<-stopped, convey.ShouldEqual, context.DeadlineExceeded)
+			// 慢函数不阻塞连接上的其他请求。
+			_, err = a.RPCCall(ctx, b.Name(), "node", "echo", nil)
+			convey.So(err, convey.ShouldBeNil)
+		})
+
+		convey.Convey("Deadline", func() {
+			reply, err := a.RPCCall(ctx, b.Name(), "node", "deadline", nil)
+			convey.So(err, convey.ShouldBeNil)
+			remaining, err := time.ParseDuration(string(reply))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(remaining, convey.ShouldBeGreaterThan, 0)
+			convey.So(remaining, convey.ShouldBeLessThanOrEqualTo, time.Second)
+			_, err = a.RPCCall(context.Background(), b.Name(), "node", "deadline", nil)
+			convey.So(err, convey.ShouldWrap, ErrRPCFailed)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "no deadline")
+		})
+
+		convey.Convey("MultiCall", func() {
+			nodes := []string{a.Name(), b.Name(), c.Name(), "rpc_none"}
+			results := a.MultiCall(ctx, nodes, "node", "echo", []byte("hi"))
+			convey.So(results, convey.ShouldHaveLength, 4)
+			for i, name := range nodes[:3] {
+				convey.So(results[i].Node, convey.ShouldEqual, name)
+				convey.So(results[i].Err, convey.ShouldBeNil)
+				convey.So(string(results[i].Reply), convey.ShouldEqual, name+":hi")
+			}
+			convey.So(results[3].Err, convey.ShouldEqual, ErrNotConnected)
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
@@ -2,12 +2,14 @@ package godist
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	"github.com/zhuangsirui/binpacker"
 	"github.com/zhuangsirui/godist/base"
@@ -17,6 +19,30 @@ const (
 	REQ_CAST      = 0x01
 	REQ_CONN      = 0x02
 	REQ_QUERY_ALL = 0x03
+	REQ_CALL      = 0x04
+	REQ_REPLY     = 0x05
+	REQ_SEND      = 0x06
+	REQ_CAST_NAME = 0x07
+
+	REQ_GLOBAL_REGISTER   = 0x08
+	REQ_GLOBAL_UNREGISTER = 0x09
+	REQ_GLOBAL_SYNC       = 0x0a
+
+	REQ_PG_JOIN  = 0x0b
+	REQ_PG_LEAVE = 0x0c
+	REQ_PG_SYNC  = 0x0d
+
+	REQ_MONITOR   = 0x0e
+	REQ_DEMONITOR = 0x0f
+	REQ_DOWN      = 0x10
+	REQ_LINK      = 0x11
+	REQ_UNLINK    = 0x12
+	REQ_EXIT      = 0x13
+
+	REQ_SPAWN = 0x14
+	REQ_RPC   = 0x15
+
+	REQ_CHALLENGE = 0x16
 
 	ACK_CONN_OK                = 0x01
 	ACK_CONN_NODE_EXIST        = 0x02
@@ -26,6 +52,26 @@ const (
 	ACK_QUERY_ALL_ERR          = 0x06
 	ACK_CONN_IS_RETURN         = 0x07
 	ACK_CONN_IS_NOT_RETURN     = 0x08
+	ACK_CALL_OK                = 0x09
+	ACK_CALL_REJECTED          = 0x0a
+	ACK_REPLY_OK               = 0x0b
+	ACK_REPLY_CALL_NOT_FOUND   = 0x0c
+	ACK_SEND_STALE_PID         = 0x0d
+	ACK_CAST_NAME_NOT_FOUND    = 0x0e
+	ACK_GLOBAL_OK              = 0x0f
+	ACK_PG_OK                  = 0x10
+	ACK_MONITOR_OK             = 0x11
+	ACK_MONITOR_NOPROC         = 0x12
+	ACK_LINK_OK                = 0x13
+	ACK_LINK_NOPROC            = 0x14
+	ACK_CAST_MAILBOX_FULL      = 0x15
+	ACK_SPAWN_OK               = 0x16
+	ACK_SPAWN_NOT_FOUND        = 0x17
+	ACK_SPAWN_FAILED           = 0x18
+	ACK_RPC_OK                 = 0x19
+	ACK_RPC_NOT_FOUND          = 0x1a
+	ACK_CHALLENGE_OK           = 0x1b
+	ACK_CONN_AUTH_FAILED       = 0x1c
 )
 
 var PORTS = []uint16{
@@ -33,13 +79,16 @@ var PORTS = []uint16{
 	9190, 9191, 9192, 9193, 9194, 9195, 9196, 9197, 9198, 9199,
 }
 
-// 监听目标端口。
-func (agent *Agent) Listen() {
-	agent.listen()
+// 监听目标端口。 `PORTS` 中的端口都无法监听时返回 ErrListenFailed 。
+func (agent *Agent) Listen() error {
+	if err := agent.listen(); err != nil {
+		return err
+	}
 	agent.registerNode(agent.Node())
+	return nil
 }
 
-func (agent *Agent) listen() {
+func (agent *Agent) listen() error {
 	var errMessages []string
 	agent.listener = nil
 	for _, port := range PORTS {
@@ -65,17 +114,21 @@ func (agent *Agent) listen() {
 		break
 	}
 	if agent.listener == nil {
-		log.Panicf(strings.Join(errMessages, "\n"))
+		return fmt.Errorf("%w: %s", ErrListenFailed, strings.Join(errMessages, "\n"))
 	}
 	log.Printf("godist.agent Listen %s successful.", agent.listener.Addr())
+	return nil
 }
 
 // 接收请求循环。
 func (agent *Agent) Serve() {
 	defer func() {
 		agent.listener.Close()
-		if !agent.isStop {
-			agent.listen()
+		if !agent.isStop.Load() {
+			if err := agent.listen(); err != nil {
+				log.Printf("godist.agent agent restart failed: %s", err)
+				return
+			}
 			log.Printf("godist.agent agent restarted")
 			go agent.Serve()
 		}
@@ -92,50 +145,68 @@ func (agent *Agent) Serve() {
 	}
 }
 
-// Request message described
-// +------------------+
-// | length | request |
-// |------------------|
-// | 8      | length  |
-// +------------------+
-func (agent *Agent) handleConnection(conn *net.TCPConn) {
-	for {
-		lengthBuffer := make([]byte, 8)
-		if _, err := conn.Read(lengthBuffer); err != nil {
-			// handle error
-			conn.Close()
-			break
-		}
-		length := binary.LittleEndian.Uint16(lengthBuffer)
-		buffer := make([]byte, length)
-		if _, err := conn.Read(buffer); err != nil {
-			// handle error
-			continue
-		}
-		code, request := buffer[0], buffer[1:]
-		answer, err := agent.dispatchRequest(code, request)
-		if err != nil {
-			conn.Close()
-			break
-		}
-		if _, err := conn.Write(answer); err != nil {
-			conn.Close()
-			break
-		}
-	}
+// 为接入的连接启动读写协程。帧格式见 connection.readLoop 。设置了 TLS 时先
+// 包装为 TLS 连接。
+func (agent *Agent) handleConnection(tcpConn *net.TCPConn) {
+	newConnection(agent, agent.secureServer(tcpConn)).start()
 }
 
-// 分发请求。如果返回 error ，则中断该链接。
-func (agent *Agent) dispatchRequest(code byte, request []byte) ([]byte, error) {
+// 分发请求。对端发送没有协商的功能的请求时返回 ErrNotSupported 。如果返回 error ，
+// 则中断该链接。
+func (agent *Agent) dispatchRequest(conn *connection, requestId uint64, code byte, request []byte) ([]byte, error) {
 	var answer []byte
 	var err error
+	if !agent.requestAllowed(conn, code) {
+		return nil, ErrAuthFailed
+	}
+	if !conn.supports(requestCapability(code)) {
+		return nil, ErrNotSupported
+	}
 	switch code {
+	case REQ_CHALLENGE:
+		answer, err = agent.handleChallenge(conn, request)
 	case REQ_CONN:
-		answer, err = agent.handleConnect(request)
+		answer, err = agent.handleConnect(conn, request)
 	case REQ_CAST:
 		answer, err = agent.handleCast(request)
 	case REQ_QUERY_ALL:
 		answer, err = agent.handleQueryAllNodes(request)
+	case REQ_CALL:
+		answer, err = agent.handleCall(conn, request)
+	case REQ_REPLY:
+		answer, err = agent.handleReply(request)
+	case REQ_SEND:
+		answer, err = agent.handleSend(request)
+	case REQ_CAST_NAME:
+		answer, err = agent.handleCastToName(request)
+	case REQ_GLOBAL_REGISTER:
+		answer, err = agent.handleGlobalRegister(request)
+	case REQ_GLOBAL_UNREGISTER:
+		answer, err = agent.handleGlobalUnregister(request)
+	case REQ_GLOBAL_SYNC:
+		answer, err = agent.handleGlobalSync(request)
+	case REQ_PG_JOIN:
+		answer, err = agent.handleGroupJoin(request)
+	case REQ_PG_LEAVE:
+		answer, err = agent.handleGroupLeave(request)
+	case REQ_PG_SYNC:
+		answer, err = agent.handleGroupSync(conn, request)
+	case REQ_MONITOR:
+		answer, err = agent.handleMonitor(request)
+	case REQ_DEMONITOR:
+		answer, err = agent.handleDemonitor(request)
+	case REQ_DOWN:
+		answer, err = agent.handleDown(request)
+	case REQ_LINK:
+		answer, err = agent.handleLink(request)
+	case REQ_UNLINK:
+		answer, err = agent.handleUnlink(request)
+	case REQ_EXIT:
+		answer, err = agent.handleExit(request)
+	case REQ_SPAWN:
+		answer, err = agent.handleSpawn(conn, requestId, request)
+	case REQ_RPC:
+		answer, err = agent.handleRPC(conn, request)
 	default:
 		answer, err = []byte{}, errors.New("godist: REQ code error")
 	}
@@ -143,37 +214,114 @@ func (agent *Agent) dispatchRequest(code byte, request []byte) ([]byte, error) {
 }
 
 // Connect message described
-// +----------------------------------------------------------+
-// | port | nameLen | name    | hostLen | host    | is return |
-// |----------------------------------------------|-----------|
-// | 2    | 2       | nameLen | 2       | hostLen | 1         |
-// +----------------------------------------------------------+
+// +-------------------------------------------------------------------------------------------+
+// | is return | port | nameLen | name    | hostLen | host    | compressor count | compressors |
+// |-----------|----------------------------------------------|------------------|-------------|
+// | 1         | 2    | 2       | nameLen | 2       | hostLen | 1                | count       |
+// +-------------------------------------------------------------------------------------------+
+// | digest length | digest        | version | capabilities | creation |
+// |---------------|---------------|---------|--------------|----------|
+// | 1             | digest length | 2       | 8            | 4        |
+// +-----------------------------------------------------------------+
+//
+// compressors 为发起方支持的 Compressor Id ，按优先顺序排列。 digest 为发起方对
+// REQ_CHALLENGE 中本节点 challenge 的回应，没有设置 cookie 时长度为 0 。没有
+// version 和 capabilities 的是引入版本之前的节点，按照 LEGACY_CAPABILITIES 处理。
+// 新的字段只能追加在末尾，旧的节点会忽略它们。 creation 用于识别对端是否重启过。
 //
 // Answer message described
-// +--------+
-// | result |
-// |--------|
-// | 1      |
-// +--------+
-func (agent *Agent) handleConnect(request []byte) ([]byte, error) {
-	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+// +-----------------------------------------------------------+
+// | result | compressor | version | capabilities | creation |
+// |--------|------------|---------|--------------|----------|
+// | 1      | 1          | 2       | 8            | 4        |
+// +-----------------------------------------------------------+
+//
+// compressor 为选定的 Compressor Id ，不压缩时为 COMPRESS_NONE 。 version 为双方
+// 版本中较低的一个， capabilities 为本节点的功能，双方各自取交集。没有通过 cookie
+// 验证或者声明为本节点的名字时只应答 ACK_CONN_AUTH_FAILED 。
+//
+// 双方都支持 CAP_SINGLE_CONN 时，接入的连接同时用于两个方向，按照
+// Agent.acceptConn 处理同时连接的冲突，被拒绝时只应答 ACK_CONN_NODE_EXIST 。否则
+// 按照旧的方式，由本节点反向建立一条连接用于发送请求。
+func (agent *Agent) handleConnect(conn *connection, request []byte) ([]byte, error) {
 	var isReturn byte
 	var port uint16
 	var name, host string
+	var compressorCount, digestLength byte
+	var compressorIds, digest []byte
+	var version uint16
+	var creation uint32
+	capabilities := uint64(LEGACY_CAPABILITIES)
+	requestBuf := bytes.NewBuffer(request)
+	unpacker := binpacker.NewUnpacker(endian, requestBuf)
 	unpacker.FetchByte(&isReturn).
 		FetchUint16(&port).
 		StringWithUint16Prefix(&name).
-		StringWithUint16Prefix(&host)
+		StringWithUint16Prefix(&host).
+		FetchByte(&compressorCount)
+	unpacker.FetchBytes(uint64(compressorCount), &compressorIds).
+		FetchByte(&digestLength)
+	unpacker.FetchBytes(uint64(digestLength), &digest)
+	if requestBuf.Len() > 0 {
+		unpacker.FetchUint16(&version).FetchUint64(&capabilities)
+	}
+	if requestBuf.Len() > 0 {
+		unpacker.FetchUint32(&creation)
+	}
+	if err := unpacker.Error(); err != nil {
+		return nil, err
+	}
+	if name == agent.Name() {
+		log.Printf("godist.agent refuse connection claiming the name of this node")
+		return []byte{ACK_CONN_AUTH_FAILED}, nil
+	}
+	if err := agent.verifyClient(conn, name); err != nil {
+		log.Printf("godist.agent refuse connection from %s: %s", name, err)
+		return nil, err
+	}
+	if err := agent.verifyCookie(conn, name, digest); err != nil {
+		log.Printf("godist.agent refuse connection from %s: %s", name, err)
+		return []byte{ACK_CONN_AUTH_FAILED}, nil
+	}
+	atomic.StoreInt32(&conn.authenticated, 1)
 	node := &base.Node{
 		Name: name,
 		Host: host,
 		Port: port,
 	}
+	conn.name = name
+	conn.setPeerCreation(creation)
 	agent.registerNode(node)
-	if isReturn != ACK_CONN_IS_RETURN {
-		go agent.connectTo(node.FullName(), true)
+	conn.negotiate(version, capabilities)
+	var compressorId byte = COMPRESS_NONE
+	if conn.supports(CAP_COMPRESS) {
+		if compressor := agent.negotiateCompressor(compressorIds); compressor != nil {
+			// 应答很短，压缩后不会变小，会按原样发送。
+			conn.setCompressor(compressor)
+			compressorId = compressor.Id()
+		}
+	}
+	if !conn.supports(CAP_SINGLE_CONN) {
+		// 已经持有到对端的连接时不再反向连接，避免替换掉正在使用的连接。
+		if isReturn != ACK_CONN_IS_RETURN && !agent.connExist(name) {
+			go func() {
+				if err := agent.connectTo(node.FullName(), true); err != nil {
+					log.Printf("godist.agent return connect to %s error: %s", name, err)
+				}
+			}()
+		}
+	} else if !agent.acceptConn(name, conn) {
+		log.Printf("godist.agent node %s already connected, refuse the new connection", name)
+		return []byte{ACK_CONN_NODE_EXIST}, nil
 	}
-	return []byte{ACK_CONN_OK}, nil
+	answerBuf := new(bytes.Buffer)
+	binpacker.NewPacker(endian, answerBuf).
+		PushByte(ACK_CONN_OK).
+		PushByte(compressorId).
+		PushUint16(conn.getVersion()).
+		PushUint64(agent.capabilities).
+		PushUint32(agent.creation)
+	return answerBuf.Bytes(), nil
 }
 
 // Query message described
@@ -216,11 +364,14 @@ func (agent *Agent) handleQueryAllNodes(request []byte) ([]byte, error) {
 }
 
 // Cast message described
-// +----------------------------------------------+
-// | routine id | message length | message        |
-// |------------|----------------|----------------|
-// | 8          | 8              | message length |
-// +----------------------------------------------+
+// +--------------------------------------------------------+
+// | routine id | message length | message        | codec |
+// |------------|----------------|----------------|-------|
+// | 8          | 8              | message length | 1     |
+// +--------------------------------------------------------+
+//
+// codec 为消息使用的 Codec Id ，只在双方都支持 CAP_CODEC 时发送，没有时为
+// CODEC_NONE 。
 //
 // Answer message described
 // +--------+
@@ -231,13 +382,166 @@ func (agent *Agent) handleQueryAllNodes(request []byte) ([]byte, error) {
 func (agent *Agent) handleCast(request []byte) ([]byte, error) {
 	var routineId uint64
 	var message []byte
-	binpacker.NewUnpacker(endian, bytes.NewBuffer(request)).
-		FetchUint64(&routineId).
+	var codec byte = CODEC_NONE
+	requestBuf := bytes.NewBuffer(request)
+	unpacker := binpacker.NewUnpacker(endian, requestBuf)
+	unpacker.FetchUint64(&routineId).
 		BytesWithUint64Perfix(&message)
+	if requestBuf.Len() > 0 {
+		unpacker.FetchByte(&codec)
+	}
 	if routine, exist := agent.findRoutine(base.RoutineId(routineId)); exist {
-		routine.Cast(message)
-		return []byte{ACK_CAST_OK}, nil
+		return []byte{deliverAck(deliverRemote(routine, codec, message), ACK_CAST_ROUTINE_NOT_FOUND)}, nil
 	} else {
 		return []byte{ACK_CAST_ROUTINE_NOT_FOUND}, nil
 	}
 }
+
+// 投递来自其他节点的消息。调用方是连接的读协程，因此 OVERFLOW_BLOCK 没有设置
+// Timeout 时信箱已满直接应答 ACK_CAST_MAILBOX_FULL ，避免一个 Process 阻塞整条
+// 连接和心跳。
+func deliverRemote(routine *base.Routine, codec byte, message []byte) base.DeliverResult {
+	return routine.DeliverEncodedWithin(codec, message, 0)
+}
+
+// 将投递结果转换为应答码。 Goroutine 已经退出时返回 notFound 。信箱已满时返回
+// ACK_CAST_MAILBOX_FULL 。
+func deliverAck(result base.DeliverResult, notFound byte) byte {
+	switch result {
+	case base.DELIVER_FULL:
+		return ACK_CAST_MAILBOX_FULL
+	case base.DELIVER_CLOSED:
+		return notFound
+	}
+	return ACK_CAST_OK
+}
+
+// Call message described
+// +--------------------------------------------------------+
+// | call id | routine id | message length | message        |
+// |---------|------------|----------------|----------------|
+// | 8       | 8          | 8              | message length |
+// +--------------------------------------------------------+
+//
+// 回复会通过请求到达的连接以 REQ_REPLY 发回。
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleCall(conn *connection, request []byte) ([]byte, error) {
+	var callId, routineId uint64
+	var message []byte
+	binpacker.NewUnpacker(endian, bytes.NewBuffer(request)).
+		FetchUint64(&callId).
+		FetchUint64(&routineId).
+		BytesWithUint64Perfix(&message)
+	routine, exist := agent.findRoutine(base.RoutineId(routineId))
+	if !exist {
+		return []byte{ACK_CAST_ROUTINE_NOT_FOUND}, nil
+	}
+	req := base.NewRequestContext(message, func(ctx context.Context, reply []byte) error {
+		return agent.replyTo(ctx, conn, callId, reply)
+	})
+	if !routine.Call(req) {
+		return []byte{ACK_CALL_REJECTED}, nil
+	}
+	return []byte{ACK_CALL_OK}, nil
+}
+
+// Reply message described
+// +-------------------------------------------+
+// | call id | message length | message        |
+// |---------|----------------|----------------|
+// | 8       | 8              | message length |
+// +-------------------------------------------+
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleReply(request []byte) ([]byte, error) {
+	var callId uint64
+	var message []byte
+	binpacker.NewUnpacker(endian, bytes.NewBuffer(request)).
+		FetchUint64(&callId).
+		BytesWithUint64Perfix(&message)
+	if agent.deliverReply(callId, message) {
+		return []byte{ACK_REPLY_OK}, nil
+	}
+	return []byte{ACK_REPLY_CALL_NOT_FOUND}, nil
+}
+
+// Send message described
+// +-------------------------------------------------------------------+
+// | pid length | pid        | message length | message        | codec |
+// |------------|------------|----------------|----------------|-------|
+// | 2          | pid length | 8              | message length | 1     |
+// +-------------------------------------------------------------------+
+//
+// pid 的编码见 base.Pid.MarshalBinary 。 codec 与 REQ_CAST 相同。
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleSend(request []byte) ([]byte, error) {
+	var pid base.Pid
+	var message []byte
+	var codec byte = CODEC_NONE
+	requestBuf := bytes.NewBuffer(request)
+	unpacker := binpacker.NewUnpacker(endian, requestBuf)
+	if err := fetchPid(unpacker, &pid); err != nil {
+		return nil, err
+	}
+	if err := unpacker.BytesWithUint64Perfix(&message).Error(); err != nil {
+		return nil, err
+	}
+	if requestBuf.Len() > 0 {
+		unpacker.FetchByte(&codec)
+	}
+	if pid.Node != agent.Name() {
+		return []byte{ACK_CAST_ROUTINE_NOT_FOUND}, nil
+	}
+	if pid.Creation != agent.creation {
+		return []byte{ACK_SEND_STALE_PID}, nil
+	}
+	if routine, exist := agent.findRoutine(pid.Id); exist {
+		return []byte{deliverAck(deliverRemote(routine, codec, message), ACK_CAST_ROUTINE_NOT_FOUND)}, nil
+	}
+	return []byte{ACK_CAST_ROUTINE_NOT_FOUND}, nil
+}
+
+// Cast to name message described
+// +-------------------------------------------------------------+
+// | name length | name        | message length | message        |
+// |-------------|-------------|----------------|----------------|
+// | 2           | name length | 8              | message length |
+// +-------------------------------------------------------------+
+//
+// Answer message described
+// +--------+
+// | result |
+// |--------|
+// | 1      |
+// +--------+
+func (agent *Agent) handleCastToName(request []byte) ([]byte, error) {
+	var name string
+	var message []byte
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+	unpacker.StringWithUint16Prefix(&name).
+		BytesWithUint64Perfix(&message)
+	if unpacker.Error() != nil {
+		return nil, unpacker.Error()
+	}
+	if routine, exist := agent.findNamedRoutine(name); exist {
+		return []byte{deliverAck(deliverRemote(routine, CODEC_NONE, message), ACK_CAST_NAME_NOT_FOUND)}, nil
+	}
+	return []byte{ACK_CAST_NAME_NOT_FOUND}, nil
+}
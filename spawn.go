@@ -0,0 +1,244 @@
+package godist
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/zhuangsirui/binpacker"
+	"github.com/zhuangsirui/godist/base"
+)
+
+// SpawnOn 的选项。
+const (
+	SPAWN_LINK    = 0x01
+	SPAWN_MONITOR = 0x02
+)
+
+// SpawnFactory 用于在本节点创建可以被远程启动的 Process 。 process 为新创建并已经
+// 注册的 Process ， args 为 SpawnOn 传入的参数。返回的 Handlers 用于运行
+// process ；返回 error 时 process 被丢弃。
+type SpawnFactory func(process *Process, args []byte) (Handlers, error)
+
+// 注册一个可以被其他节点启动的 Process 工厂。名字已经注册时返回
+// ErrNameRegistered 。
+func (agent *Agent) RegisterSpawnable(name string, factory SpawnFactory) error {
+	agent.spawnLock.Lock()
+	defer agent.spawnLock.Unlock()
+	if _, exist := agent.spawnables[name]; exist {
+		return ErrNameRegistered
+	}
+	agent.spawnables[name] = factory
+	return nil
+}
+
+// 在 nodeName 节点上使用名为 name 的工厂启动一个 Process ，返回其 Pid 。 ctx 在
+// 对端应答之前结束时返回 ctx.Err() ，此时对端可能已经启动了 Process 。
+func (agent *Agent) SpawnOn(ctx context.Context, nodeName, name string, args []byte) (base.Pid, error) {
+	pid, _, err := agent.spawn(ctx, nodeName, name, args, nil, 0)
+	return pid, err
+}
+
+// 启动 Process 并在其开始运行之前与 p 建立链接。
+func (p *Process) SpawnLink(ctx context.Context, nodeName, name string, args []byte) (base.Pid, error) {
+	pid, _, err := p.agent.spawn(ctx, nodeName, name, args, p.routine, SPAWN_LINK)
+	return pid, err
+}
+
+// 启动 Process 并在其开始运行之前由 p 监视。
+func (p *Process) SpawnMonitor(ctx context.Context, nodeName, name string, args []byte) (base.Pid, base.MonitorRef, error) {
+	return p.agent.spawn(ctx, nodeName, name, args, p.routine, SPAWN_MONITOR)
+}
+
+// 等待应答的 SpawnLink 。新的 Process 可能在应答到达之前就退出，这时到达的 Exit
+// 记录在 exited 中，应答之后不再登记链接。
+type spawnLink struct {
+	watcher base.RoutineId
+	node    string
+	exited  map[base.Pid]bool
+}
+
+// 记录 from 发给 to 的 Exit 。调用方需要持有 monitorLock 。
+func (agent *Agent) spawnExited(from base.Pid, to base.RoutineId) {
+	for pending := range agent.spawnLinks {
+		if pending.watcher == to && pending.node == from.Node {
+			pending.exited[from] = true
+		}
+	}
+}
+
+func (agent *Agent) spawn(ctx context.Context, nodeName, name string, args []byte, watcher *base.Routine, flags byte) (base.Pid, base.MonitorRef, error) {
+	var watcherPid base.Pid
+	var ref base.MonitorRef
+	var pending *spawnLink
+	if watcher != nil {
+		watcherPid = agent.Pid(watcher.GetId())
+	}
+	if flags&SPAWN_LINK != 0 {
+		pending = &spawnLink{
+			watcher: watcher.GetId(),
+			node:    nodeName,
+			exited:  make(map[base.Pid]bool),
+		}
+		agent.monitorLock.Lock()
+		agent.spawnLinks[pending] = true
+		agent.monitorLock.Unlock()
+	}
+	if flags&SPAWN_MONITOR != 0 {
+		// 先登记监视，新的 Process 可能在应答到达之前就退出。
+		ref = base.MonitorRef(atomic.AddUint64(&agent.monitorCounter, 1))
+		agent.monitorLock.Lock()
+		agent.watching[ref] = watch{
+			watcher: watcher.GetId(),
+			target:  base.Pid{Node: nodeName},
+		}
+		agent.monitorLock.Unlock()
+	}
+	pid, err := agent.spawnAt(ctx, nodeName, name, args, watcherPid, ref, flags)
+	agent.monitorLock.Lock()
+	defer agent.monitorLock.Unlock()
+	if pending != nil {
+		delete(agent.spawnLinks, pending)
+	}
+	if err != nil {
+		if flags&SPAWN_MONITOR != 0 {
+			delete(agent.watching, ref)
+		}
+		return base.Pid{}, 0, err
+	}
+	if pending != nil && !pending.exited[pid] {
+		agent.addLink(watcher.GetId(), pid)
+	}
+	if w, exist := agent.watching[ref]; exist && flags&SPAWN_MONITOR != 0 {
+		w.target = pid
+		agent.watching[ref] = w
+	}
+	return pid, ref, nil
+}
+
+func (agent *Agent) spawnAt(ctx context.Context, nodeName, name string, args []byte, watcher base.Pid, ref base.MonitorRef, flags byte) (base.Pid, error) {
+	if nodeName == agent.Name() {
+		return agent.spawnLocal(name, args, watcher, ref, flags)
+	}
+	conn, exist := agent.findConn(nodeName)
+	if !exist {
+		return base.Pid{}, ErrNotConnected
+	}
+	requestBuf := new(bytes.Buffer)
+	pk := binpacker.NewPacker(endian, requestBuf).
+		PushUint16(uint16(len(name))).
+		PushString(name).
+		PushByte(flags)
+	if flags != 0 {
+		pushPid(pk, watcher).PushUint64(uint64(ref))
+	}
+	pk.PushUint64(uint64(len(args))).PushBytes(args)
+	answer, err := conn.requestContext(ctx, REQ_SPAWN, requestBuf.Bytes())
+	if err != nil {
+		return base.Pid{}, err
+	}
+	if len(answer) == 0 {
+		return base.Pid{}, ErrBadAnswer
+	}
+	switch answer[0] {
+	case ACK_SPAWN_OK:
+	case ACK_SPAWN_NOT_FOUND:
+		return base.Pid{}, ErrSpawnableNotFound
+	case ACK_SPAWN_FAILED:
+		return base.Pid{}, ErrSpawnFailed
+	default:
+		return base.Pid{}, ErrBadAnswer
+	}
+	var pid base.Pid
+	if err := fetchPid(binpacker.NewUnpacker(endian, bytes.NewBuffer(answer[1:])), &pid); err != nil {
+		return base.Pid{}, ErrBadAnswer
+	}
+	return pid, nil
+}
+
+// 在本节点创建并运行 Process 。链接和监视在 Process 开始运行之前登记。
+func (agent *Agent) spawnLocal(name string, args []byte, watcher base.Pid, ref base.MonitorRef, flags byte) (base.Pid, error) {
+	agent.spawnLock.RLock()
+	factory, exist := agent.spawnables[name]
+	agent.spawnLock.RUnlock()
+	if !exist {
+		return base.Pid{}, ErrSpawnableNotFound
+	}
+	process := agent.NewProcess()
+	handlers, err := factory(process, args)
+	if err != nil {
+		agent.routineExited(process.GetId(), err.Error())
+		return base.Pid{}, fmt.Errorf("%w: %v", ErrSpawnFailed, err)
+	}
+	agent.monitorLock.Lock()
+	if flags&SPAWN_LINK != 0 {
+		agent.addLink(process.GetId(), watcher)
+	}
+	if flags&SPAWN_MONITOR != 0 {
+		agent.addMonitorEntry(process.GetId(), monitorKey{ref, watcher.Node}, watcher)
+	}
+	agent.monitorLock.Unlock()
+	go process.Serve(handlers)
+	return process.Pid(), nil
+}
+
+// Spawn message described
+// +-------------------------------------------------------------------------+
+// | name length | name        | flags | watcher | ref | args length | args |
+// |-------------|-------------|-------|---------|-----|-------------|------|
+// | 2           | name length | 1     | pid     | 8   | 8           | args |
+// +-------------------------------------------------------------------------+
+//
+// flags 为 0 时没有 watcher 和 ref 。
+//
+// Answer message described
+// +--------------+
+// | result | pid |
+// |--------|-----|
+// | 1      | pid |
+// +--------------+
+//
+// 只有 result 为 ACK_SPAWN_OK 时带有 pid 。工厂函数可能向本连接发送请求，因此在
+// 读协程之外运行，之后再应答。
+func (agent *Agent) handleSpawn(conn *connection, requestId uint64, request []byte) ([]byte, error) {
+	unpacker := binpacker.NewUnpacker(endian, bytes.NewBuffer(request))
+	var name string
+	var flags byte
+	var watcher base.Pid
+	var ref uint64
+	var args []byte
+	if err := unpacker.StringWithUint16Prefix(&name).FetchByte(&flags).Error(); err != nil {
+		return nil, err
+	}
+	if flags != 0 {
+		if err := fetchPid(unpacker, &watcher); err != nil {
+			return nil, err
+		}
+		unpacker.FetchUint64(&ref)
+	}
+	if err := unpacker.BytesWithUint64Perfix(&args).Error(); err != nil {
+		return nil, err
+	}
+	go func() {
+		answer := agent.spawnAnswer(name, args, watcher, base.MonitorRef(ref), flags)
+		if err := conn.answer(requestId, answer); err != nil {
+			log.Printf("godist.spawn answer %s to %s error: %s", name, conn.name, err)
+		}
+	}()
+	return nil, errAnswerLater
+}
+
+func (agent *Agent) spawnAnswer(name string, args []byte, watcher base.Pid, ref base.MonitorRef, flags byte) []byte {
+	pid, err := agent.spawnLocal(name, args, watcher, ref, flags)
+	switch {
+	case err == ErrSpawnableNotFound:
+		return []byte{ACK_SPAWN_NOT_FOUND}
+	case err != nil:
+		return []byte{ACK_SPAWN_FAILED}
+	}
+	answerBuf := new(bytes.Buffer)
+	pushPid(binpacker.NewPacker(endian, answerBuf).PushByte(ACK_SPAWN_OK), pid)
+	return answerBuf.Bytes()
+}
@@ -0,0 +1,121 @@
+package godist
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+// 以 args 为名字注册，收到任意消息时以该消息为原因退出。
+func echoFactory(process *Process, args []byte) (Handlers, error) {
+	if len(args) == 0 {
+		return Handlers{}, errors.New("name required")
+	}
+	if err := process.RegisterName(string(args)); err != nil {
+		return Handlers{}, err
+	}
+	return Handlers{
+		Cast: func(message []byte) error {
+			return errors.New(string(message))
+		},
+	}, nil
+}
+
+func TestSpawn(t *testing.T) {
+	convey.Convey("Remote spawn", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		agents := startAgents(gpmdPort, "spawn_a", "spawn_b")
+		a, b := agents[0], agents[1]
+		convey.So(b.RegisterSpawnable("echo", echoFactory), convey.ShouldBeNil)
+		convey.So(b.RegisterSpawnable("echo", echoFactory), convey.ShouldEqual, ErrNameRegistered)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		convey.Convey("Spawn", func() {
+			pid, err := a.SpawnOn(ctx, b.Name(), "echo", []byte("worker"))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(pid.Node, convey.ShouldEqual, b.Name())
+			where, _ := b.WhereIs("worker")
+			convey.So(where, convey.ShouldResemble, pid)
+
+			_, err = a.SpawnOn(ctx, b.Name(), "missing", nil)
+			convey.So(err, convey.ShouldEqual, ErrSpawnableNotFound)
+			_, err = a.SpawnOn(ctx, b.Name(), "echo", nil)
+			convey.So(err, convey.ShouldEqual, ErrSpawnFailed)
+			_, err = b.SpawnOn(ctx, b.Name(), "echo", nil)
+			convey.So(err, convey.ShouldWrap, ErrSpawnFailed)
+		})
+
+		convey.Convey("Spawn monitor", func() {
+			watcher := a.NewProcess()
+			pid, ref, err := watcher.SpawnMonitor(ctx, b.Name(), "echo", []byte("monitored"))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(a.Send(pid, []byte("crash")), convey.ShouldBeNil)
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Down{
+				Ref:    ref,
+				Pid:    pid,
+				Reason: "crash",
+			})
+		})
+
+		convey.Convey("Spawn link", func() {
+			watcher := a.NewProcess()
+			watcher.TrapExit(true)
+			pid, err := watcher.SpawnLink(ctx, b.Name(), "echo", []byte("linked"))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(a.Send(pid, []byte("crash")), convey.ShouldBeNil)
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Exit{
+				From:   pid,
+				Reason: "crash",
+			})
+		})
+
+		convey.Convey("Child exits at once", func() {
+			convey.So(b.RegisterSpawnable("quick", func(process *Process, args []byte) (Handlers, error) {
+				process.Stop("done")
+				return Handlers{Cast: func([]byte) error { return nil }}, nil
+			}), convey.ShouldBeNil)
+			watcher := a.NewProcess()
+			watcher.TrapExit(true)
+			pid, err := watcher.SpawnLink(ctx, b.Name(), "quick", nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(receiveSignal(watcher), convey.ShouldResemble, base.Exit{
+				From:   pid,
+				Reason: "done",
+			})
+			a.monitorLock.RLock()
+			linked := a.links[watcher.GetId()][pid]
+			a.monitorLock.RUnlock()
+			convey.So(linked, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Factory calls back", func() {
+			server := a.NewProcess()
+			go server.RunWithCall(func([]byte) error { return nil }, func(request *base.Request) error {
+				return request.Reply(request.Message)
+			})
+			convey.So(b.RegisterSpawnable("caller", func(process *Process, args []byte) (Handlers, error) {
+				reply, err := b.CallTo(ctx, a.Name(), server.GetId(), args)
+				if err != nil {
+					return Handlers{}, err
+				}
+				return Handlers{}, process.RegisterName(string(reply))
+			}), convey.ShouldBeNil)
+			pid, err := a.SpawnOn(ctx, b.Name(), "caller", []byte("called"))
+			convey.So(err, convey.ShouldBeNil)
+			where, _ := b.WhereIs("called")
+			convey.So(where, convey.ShouldResemble, pid)
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}
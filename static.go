@@ -1,6 +1,12 @@
 package godist
 
-import "github.com/zhuangsirui/godist/base"
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/zhuangsirui/godist/base"
+)
 
 var _agent *Agent
 
@@ -13,15 +19,18 @@ var _agent *Agent
 // 当需要向集群上其他 Goroutine 发送消息时，需要知道该 Goroutine 的宿主节点名称
 // 以及该 Goroutine 的 ID 。然后调用 `godist.Cast(hostname, routineId, message)`
 // 向目标 Goroutine 发送消息。消息格式是 []byte 。
-func Init(name string) {
+func Init(name string) error {
 	_agent = New(name)
-	_agent.Listen()
+	if err := _agent.Listen(); err != nil {
+		return err
+	}
 	go _agent.Serve()
 	//_agent.Register()
+	return nil
 }
 
-func Stop() {
-	_agent.Stop()
+func Stop() error {
+	return _agent.Stop()
 }
 
 func Stopped() {
@@ -34,12 +43,22 @@ func SetGPMD(host string, port uint16) {
 	_agent.gpmd.Port = port
 }
 
-func Register() {
-	_agent.Register()
+// 设置连接的心跳间隔。
+func SetNetTick(interval time.Duration, missed int) {
+	_agent.SetNetTick(interval, missed)
+}
+
+// 设置自动重连策略。
+func SetReconnectPolicy(policy ReconnectPolicy) {
+	_agent.SetReconnectPolicy(policy)
+}
+
+func Register() error {
+	return _agent.Register()
 }
 
-func Unregister() {
-	_agent.Unregister()
+func Unregister() error {
+	return _agent.Unregister()
 }
 
 func Host() string {
@@ -58,6 +77,10 @@ func Node() *base.Node {
 	return _agent.Node()
 }
 
+func Creation() uint32 {
+	return _agent.Creation()
+}
+
 // 向本地的 agent 注册一个 Goroutine 。如果该 Goroutine 对象已经被设置过 Id ，则
 // 会抛出 panic 。
 func RegisterRoutine(routine *base.Routine) {
@@ -67,29 +90,211 @@ func RegisterRoutine(routine *base.Routine) {
 
 // 启动一个新的 Process 。返回 Process 的指针。
 func NewProcess() *Process {
-	c := make(chan []byte, 10)
-	routine := &base.Routine{
-		Channel: c,
-	}
-	RegisterRoutine(routine)
-	return &Process{
-		Channel: c,
-		routine: routine,
-	}
+	return _agent.NewProcessWithMailbox(MailboxOptions{Capacity: 10})
+}
+
+// 使用指定的信箱设置启动一个新的 Process 。
+func NewProcessWithMailbox(options MailboxOptions) *Process {
+	return _agent.NewProcessWithMailbox(options)
 }
 
-func QueryAllNode(nodeName string) {
-	_agent.QueryAllNode(nodeName)
+func QueryAllNode(nodeName string) error {
+	return _agent.QueryAllNode(nodeName)
 }
 
 // 尝试向另一个节点建立连接。建立好之后会一直保持连接。用于节点之间的 Goroutine
 // 消息收发。
-func ConnectTo(nodeName string) {
-	_agent.QueryNode(nodeName)
-	_agent.ConnectTo(nodeName)
+func ConnectTo(nodeName string) error {
+	if err := _agent.QueryNode(nodeName); err != nil {
+		return err
+	}
+	return _agent.ConnectTo(nodeName)
 }
 
 // 向目标 Goroutine 发送消息。
-func CastTo(nodeName string, routineId base.RoutineId, message []byte) {
-	_agent.CastTo(nodeName, routineId, message)
+func CastTo(nodeName string, routineId base.RoutineId, message []byte) error {
+	return _agent.CastTo(nodeName, routineId, message)
+}
+
+// 向目标 Goroutine 发送请求并等待回复。
+func CallTo(ctx context.Context, nodeName string, routineId base.RoutineId, message []byte) ([]byte, error) {
+	return _agent.CallTo(ctx, nodeName, routineId, message)
+}
+
+// 向 Pid 指向的 Goroutine 发送消息。
+func Send(pid base.Pid, message []byte) error {
+	return _agent.Send(pid, message)
+}
+
+// 为本节点的 Goroutine 注册一个名字。
+func RegisterName(name string, routine *base.Routine) error {
+	return _agent.RegisterName(name, routine)
+}
+
+// 查找名字对应的 Goroutine 。
+func WhereIs(name string) (base.Pid, bool) {
+	return _agent.WhereIs(name)
+}
+
+func UnregisterName(name string) error {
+	return _agent.UnregisterName(name)
+}
+
+// 按名字向目标节点上的 Goroutine 发送消息。
+func CastToName(nodeName string, name string, message []byte) error {
+	return _agent.CastToName(nodeName, name, message)
+}
+
+// 在整个集群中注册一个名字。
+func RegisterGlobal(name string, pid base.Pid) error {
+	return _agent.RegisterGlobal(name, pid)
+}
+
+func UnregisterGlobal(name string) error {
+	return _agent.UnregisterGlobal(name)
+}
+
+// 查找全局名字对应的 Pid 。
+func WhereIsGlobal(name string) (base.Pid, bool) {
+	return _agent.WhereIsGlobal(name)
+}
+
+// 设置全局名字的冲突处理函数。
+func SetGlobalResolver(resolver GlobalResolver) {
+	_agent.SetGlobalResolver(resolver)
+}
+
+// 将本节点的 Goroutine 加入进程组。
+func Join(group string, pid base.Pid) error {
+	return _agent.Join(group, pid)
+}
+
+func Leave(group string, pid base.Pid) error {
+	return _agent.Leave(group, pid)
+}
+
+// 返回进程组在整个集群中的成员。
+func Members(group string) []base.Pid {
+	return _agent.Members(group)
+}
+
+func LocalMembers(group string) []base.Pid {
+	return _agent.LocalMembers(group)
+}
+
+// 向进程组的所有成员发送消息。
+func Broadcast(group string, message []byte) error {
+	return _agent.Broadcast(group, message)
+}
+
+// 监视 target 。
+func Monitor(watcher *base.Routine, target base.Pid) base.MonitorRef {
+	return _agent.Monitor(watcher, target)
+}
+
+func Demonitor(ref base.MonitorRef) {
+	_agent.Demonitor(ref)
+}
+
+// 在 routine 和 target 之间建立链接。
+func Link(routine *base.Routine, target base.Pid) error {
+	return _agent.Link(routine, target)
+}
+
+func Unlink(routine *base.Routine, target base.Pid) error {
+	return _agent.Unlink(routine, target)
+}
+
+// 订阅节点上下线事件。
+func SubscribeNodeEvents() (<-chan NodeEvent, func()) {
+	return _agent.SubscribeNodeEvents()
+}
+
+// 注册 Codec 。
+func RegisterCodec(codec Codec) error {
+	return _agent.RegisterCodec(codec)
+}
+
+func SetDefaultCodec(id byte) error {
+	return _agent.SetDefaultCodec(id)
+}
+
+// 使用默认 Codec 编码 v 。
+func Encode(v interface{}) ([]byte, error) {
+	return _agent.Encode(v)
+}
+
+// 按照消息中的 Codec Id 解码到 v 中。
+func Decode(message []byte, v interface{}) error {
+	return _agent.Decode(message, v)
+}
+
+// 注册一个可以被其他节点启动的 Process 工厂。
+func RegisterSpawnable(name string, factory SpawnFactory) error {
+	return _agent.RegisterSpawnable(name, factory)
+}
+
+// 在目标节点上启动一个 Process 。
+func SpawnOn(ctx context.Context, nodeName, name string, args []byte) (base.Pid, error) {
+	return _agent.SpawnOn(ctx, nodeName, name, args)
+}
+
+// 注册 RPC 函数。
+func RegisterFunc(module, function string, fn RPCFunc) error {
+	return _agent.RegisterFunc(module, function, fn)
+}
+
+// 在目标节点上调用 RPC 函数。
+func RPCCall(ctx context.Context, nodeName, module, function string, args []byte) ([]byte, error) {
+	return _agent.RPCCall(ctx, nodeName, module, function, args)
+}
+
+// 并行地在多个节点上调用 RPC 函数。
+func MultiCall(ctx context.Context, nodes []string, module, function string, args []byte) []RPCResult {
+	return _agent.MultiCall(ctx, nodes, module, function, args)
+}
+
+// d 之后向 pid 发送 message 。
+func SendAfter(d time.Duration, pid base.Pid, message []byte) TimerRef {
+	return _agent.SendAfter(d, pid, message)
+}
+
+// 每隔 interval 向 pid 发送一次 message 。
+func SendInterval(interval time.Duration, pid base.Pid, message []byte) TimerRef {
+	return _agent.SendInterval(interval, pid, message)
+}
+
+// 取消定时器。
+func CancelTimer(ref TimerRef) bool {
+	return _agent.CancelTimer(ref)
+}
+
+// 设置单条请求或者应答的最大长度。
+func SetMaxMessageSize(size uint64) {
+	_agent.SetMaxMessageSize(size)
+}
+
+// 设置建立连接时提供的 Compressor 。
+func SetCompression(threshold int, compressors ...Compressor) {
+	_agent.SetCompression(threshold, compressors...)
+}
+
+// 使用 TLS 加密节点之间的连接。
+func SetTLS(config *tls.Config) {
+	_agent.SetTLS(config)
+}
+
+// 设置节点之间共享的 cookie 。
+func SetCookie(cookie string) {
+	_agent.SetCookie(cookie)
+}
+
+// 从文件中读取 cookie 。
+func LoadCookie(path string) error {
+	return _agent.LoadCookie(path)
+}
+
+// 限制本节点提供的功能。
+func SetCapabilities(capabilities uint64) {
+	_agent.SetCapabilities(capabilities)
 }
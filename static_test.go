@@ -18,9 +18,9 @@ func TestStatic(t *testing.T) {
 		m.Serve()
 
 		convey.Convey("Init", func() {
-			Init("static@localhost")
+			convey.So(Init("static@localhost"), convey.ShouldBeNil)
 			SetGPMD(testhost, gpmdPort)
-			Register()
+			convey.So(Register(), convey.ShouldBeNil)
 			convey.So(Host(), convey.ShouldEqual, testhost)
 			convey.So(Name(), convey.ShouldEqual, "static")
 			convey.So(Port(), convey.ShouldEqual, _agent.Port())
@@ -34,7 +34,7 @@ func TestStatic(t *testing.T) {
 
 				convey.Convey("Cast local", func() {
 					ping := []byte("ping")
-					CastTo(_agent.Name(), routine.GetId(), ping)
+					convey.So(CastTo(_agent.Name(), routine.GetId(), ping), convey.ShouldBeNil)
 					convey.So(<-routine.Channel, convey.ShouldResemble, ping)
 				})
 
@@ -44,8 +44,8 @@ func TestStatic(t *testing.T) {
 					agent.SetGPMD(agent.Host(), gpmdPort)
 					agent.Register()
 					go agent.Serve()
-					ConnectTo(agent.Node().FullName())
-					QueryAllNode(agent.Node().FullName())
+					convey.So(ConnectTo(agent.Node().FullName()), convey.ShouldBeNil)
+					convey.So(QueryAllNode(agent.Node().FullName()), convey.ShouldBeNil)
 
 					convey.Convey("Cast remote", func() {
 						routine := &base.Routine{
@@ -53,7 +53,7 @@ func TestStatic(t *testing.T) {
 						}
 						ping := []byte("ping")
 						agent.RegisterRoutine(routine)
-						CastTo(agent.Name(), routine.GetId(), ping)
+						convey.So(CastTo(agent.Name(), routine.GetId(), ping), convey.ShouldBeNil)
 						convey.So(<-routine.Channel, convey.ShouldResemble, ping)
 					})
 					agent.Stop()
@@ -0,0 +1,285 @@
+package godist
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zhuangsirui/godist/base"
+)
+
+// 子进程退出时的重启策略。
+type Strategy uint8
+
+const (
+	// 只重启退出的子进程。
+	ONE_FOR_ONE Strategy = iota
+	// 停止其余子进程，然后重启所有子进程。
+	ONE_FOR_ALL
+	// 停止排在退出的子进程之后的子进程，然后重启它们。
+	REST_FOR_ONE
+)
+
+// 子进程的重启类型。
+type RestartType uint8
+
+const (
+	// 总是重启。
+	PERMANENT RestartType = iota
+	// 退出原因不为 REASON_NORMAL 和 REASON_SHUTDOWN 时重启。
+	TRANSIENT
+	// 从不重启。
+	TEMPORARY
+)
+
+const (
+	DEFAULT_MAX_RESTARTS   = 3
+	DEFAULT_RESTART_PERIOD = 5 * time.Second
+	// 停止子进程时等待其退出的时间。
+	SUPERVISOR_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+var errRestartIntensity = errors.New("reached max restart intensity")
+
+// ChildSpec 描述一个由 Supervisor 管理的子进程。
+//
+// Factory 用于创建子进程，为 nil 时使用 Agent.NewProcess ，子进程使用 Handlers
+// 运行。设置了 Supervisor 时子进程为嵌套的 Supervisor ，忽略 Factory 和
+// Handlers 。 Name 不为空时子进程每次启动都会注册该名字。
+type ChildSpec struct {
+	Id         string
+	Name       string
+	Restart    RestartType
+	Factory    func() *Process
+	Handlers   Handlers
+	Supervisor *SupervisorSpec
+}
+
+// SupervisorSpec 描述一个 Supervisor 。 Period 时间内重启次数超过 MaxRestarts
+// 时， Supervisor 停止所有子进程并退出。两者为 0 时使用默认值。
+type SupervisorSpec struct {
+	Strategy    Strategy
+	MaxRestarts int
+	Period      time.Duration
+	Children    []ChildSpec
+}
+
+// Supervisor 本身也是一个 Process ，通过监视子进程得知其退出。
+type Supervisor struct {
+	agent    *Agent
+	spec     SupervisorSpec
+	process  *Process
+	children []*child
+	lock     *sync.RWMutex
+	restarts []time.Time
+}
+
+type child struct {
+	spec    ChildSpec
+	process *Process
+	ref     base.MonitorRef
+}
+
+// 启动 Supervisor 并按顺序启动所有子进程。任一子进程启动失败时停止已经启动的
+// 子进程并返回错误。
+func (agent *Agent) StartSupervisor(spec SupervisorSpec) (*Supervisor, error) {
+	if spec.MaxRestarts <= 0 {
+		spec.MaxRestarts = DEFAULT_MAX_RESTARTS
+	}
+	if spec.Period <= 0 {
+		spec.Period = DEFAULT_RESTART_PERIOD
+	}
+	s := &Supervisor{
+		agent:   agent,
+		spec:    spec,
+		process: agent.NewProcess(),
+		lock:    new(sync.RWMutex),
+	}
+	for _, childSpec := range spec.Children {
+		c := &child{spec: childSpec}
+		s.children = append(s.children, c)
+		if err := s.startChild(c); err != nil {
+			s.terminate(base.REASON_SHUTDOWN)
+			agent.unregisterRoutine(s.process.GetId())
+			return nil, err
+		}
+	}
+	go s.process.Serve(Handlers{
+		Cast:      s.handleCast,
+		Signal:    s.handleSignal,
+		Terminate: s.terminate,
+	})
+	return s, nil
+}
+
+// Supervisor 的 Pid 。
+func (s *Supervisor) Pid() base.Pid {
+	return s.process.Pid()
+}
+
+// 返回子进程当前的 Pid 。子进程没有在运行时返回 false 。
+func (s *Supervisor) Child(id string) (base.Pid, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, c := range s.children {
+		if c.spec.Id == id && c.process != nil {
+			return c.process.Pid(), true
+		}
+	}
+	return base.Pid{}, false
+}
+
+// 停止所有子进程并退出。
+func (s *Supervisor) Stop() {
+	s.process.Stop(base.REASON_SHUTDOWN)
+}
+
+// 等待 Supervisor 退出，返回退出原因。
+func (s *Supervisor) Wait() string {
+	return s.process.Wait()
+}
+
+func (s *Supervisor) handleCast([]byte) error {
+	return nil
+}
+
+func (s *Supervisor) handleSignal(signal base.Signal) error {
+	down, ok := signal.(base.Down)
+	if !ok {
+		return nil
+	}
+	failed := -1
+	s.lock.Lock()
+	for i, c := range s.children {
+		if c.process != nil && c.ref == down.Ref {
+			c.process = nil
+			failed = i
+			break
+		}
+	}
+	s.lock.Unlock()
+	if failed < 0 {
+		return nil
+	}
+	c := s.children[failed]
+	if !shouldRestart(c.spec.Restart, down.Reason) {
+		return nil
+	}
+	log.Printf("godist.supervisor child %s exit for reason: %s", c.spec.Id, down.Reason)
+	if !s.allowRestart() {
+		return errRestartIntensity
+	}
+	return s.restart(failed)
+}
+
+func shouldRestart(restart RestartType, reason string) bool {
+	switch restart {
+	case PERMANENT:
+		return true
+	case TRANSIENT:
+		return reason != base.REASON_NORMAL && reason != base.REASON_SHUTDOWN
+	}
+	return false
+}
+
+// 记录一次重启，超过重启强度时返回 false 。
+func (s *Supervisor) allowRestart() bool {
+	now := time.Now()
+	restarts := s.restarts[:0]
+	for _, at := range s.restarts {
+		if now.Sub(at) < s.spec.Period {
+			restarts = append(restarts, at)
+		}
+	}
+	s.restarts = append(restarts, now)
+	return len(s.restarts) <= s.spec.MaxRestarts
+}
+
+// 按照策略重启第 failed 个子进程。
+func (s *Supervisor) restart(failed int) error {
+	first, last := failed, failed
+	switch s.spec.Strategy {
+	case ONE_FOR_ALL:
+		first, last = 0, len(s.children)-1
+	case REST_FOR_ONE:
+		last = len(s.children) - 1
+	}
+	restarting := map[*child]bool{s.children[failed]: true}
+	for i := last; i >= first; i-- {
+		c := s.children[i]
+		if i == failed || c.process == nil {
+			continue
+		}
+		s.terminateChild(c)
+		restarting[c] = c.spec.Restart != TEMPORARY
+	}
+	for _, c := range s.children[first : last+1] {
+		if !restarting[c] {
+			continue
+		}
+		if err := s.startChild(c); err != nil {
+			log.Printf("godist.supervisor start child %s error: %s", c.spec.Id, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) startChild(c *child) error {
+	var process *Process
+	if c.spec.Supervisor != nil {
+		sub, err := s.agent.StartSupervisor(*c.spec.Supervisor)
+		if err != nil {
+			return err
+		}
+		process = sub.process
+	} else {
+		if c.spec.Factory != nil {
+			process = c.spec.Factory()
+		} else {
+			process = s.agent.NewProcess()
+		}
+		if c.spec.Name != "" {
+			if err := process.RegisterName(c.spec.Name); err != nil {
+				// 子进程还没有运行，直接从 agent 中移除。
+				s.agent.unregisterRoutine(process.GetId())
+				return err
+			}
+		}
+	}
+	ref := s.process.Monitor(process.Pid())
+	s.lock.Lock()
+	c.process = process
+	c.ref = ref
+	s.lock.Unlock()
+	if c.spec.Supervisor == nil {
+		go process.Serve(c.spec.Handlers)
+	}
+	return nil
+}
+
+// 停止子进程并等待其退出。
+func (s *Supervisor) terminateChild(c *child) {
+	s.lock.Lock()
+	process := c.process
+	c.process = nil
+	s.lock.Unlock()
+	if process == nil {
+		return
+	}
+	s.process.Demonitor(c.ref)
+	process.Stop(base.REASON_SHUTDOWN)
+	select {
+	case <-process.Done():
+	case <-time.After(SUPERVISOR_SHUTDOWN_TIMEOUT):
+		log.Printf("godist.supervisor child %s shutdown timeout", c.spec.Id)
+	}
+}
+
+// Supervisor 退出前按启动的逆序停止所有子进程。
+func (s *Supervisor) terminate(reason string) {
+	for i := len(s.children) - 1; i >= 0; i-- {
+		s.terminateChild(s.children[i])
+	}
+}
@@ -0,0 +1,189 @@
+package godist
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/base"
+)
+
+// 以收到的消息为原因退出。
+var crashHandlers = Handlers{
+	Cast: func(message []byte) error {
+		return errors.New(string(message))
+	},
+}
+
+// 等待子进程被重启为新的 Pid 。
+func waitRestarted(s *Supervisor, id string, old base.Pid) (base.Pid, bool) {
+	var pid base.Pid
+	restarted := waitFor(func() bool {
+		var running bool
+		pid, running = s.Child(id)
+		return running && pid != old
+	})
+	return pid, restarted
+}
+
+func TestSupervisor(t *testing.T) {
+	convey.Convey("Supervisor", t, func() {
+		agent := New("supervisor@localhost")
+
+		convey.Convey("One for one keeps name", func() {
+			s, err := agent.StartSupervisor(SupervisorSpec{
+				Strategy: ONE_FOR_ONE,
+				Children: []ChildSpec{
+					{Id: "a", Name: "worker_a", Handlers: crashHandlers},
+					{Id: "b", Handlers: crashHandlers},
+				},
+			})
+			convey.So(err, convey.ShouldBeNil)
+			a, _ := s.Child("a")
+			b, _ := s.Child("b")
+			where, _ := agent.WhereIs("worker_a")
+			convey.So(where, convey.ShouldResemble, a)
+
+			convey.So(agent.Send(a, []byte("crash")), convey.ShouldBeNil)
+			newA, restarted := waitRestarted(s, "a", a)
+			convey.So(restarted, convey.ShouldBeTrue)
+			where, _ = agent.WhereIs("worker_a")
+			convey.So(where, convey.ShouldResemble, newA)
+			stillB, _ := s.Child("b")
+			convey.So(stillB, convey.ShouldResemble, b)
+
+			s.Stop()
+			convey.So(s.Wait(), convey.ShouldEqual, base.REASON_SHUTDOWN)
+			_, exist := agent.WhereIs("worker_a")
+			convey.So(exist, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("One for all", func() {
+			s, _ := agent.StartSupervisor(SupervisorSpec{
+				Strategy: ONE_FOR_ALL,
+				Children: []ChildSpec{
+					{Id: "a", Handlers: crashHandlers},
+					{Id: "b", Handlers: crashHandlers},
+				},
+			})
+			a, _ := s.Child("a")
+			b, _ := s.Child("b")
+			agent.Send(b, []byte("crash"))
+			_, restarted := waitRestarted(s, "a", a)
+			convey.So(restarted, convey.ShouldBeTrue)
+			_, restarted = waitRestarted(s, "b", b)
+			convey.So(restarted, convey.ShouldBeTrue)
+			s.Stop()
+			s.Wait()
+		})
+
+		convey.Convey("Rest for one", func() {
+			s, _ := agent.StartSupervisor(SupervisorSpec{
+				Strategy: REST_FOR_ONE,
+				Children: []ChildSpec{
+					{Id: "a", Handlers: crashHandlers},
+					{Id: "b", Handlers: crashHandlers},
+					{Id: "c", Handlers: crashHandlers},
+				},
+			})
+			a, _ := s.Child("a")
+			b, _ := s.Child("b")
+			c, _ := s.Child("c")
+			agent.Send(b, []byte("crash"))
+			_, restarted := waitRestarted(s, "c", c)
+			convey.So(restarted, convey.ShouldBeTrue)
+			_, restarted = waitRestarted(s, "b", b)
+			convey.So(restarted, convey.ShouldBeTrue)
+			stillA, _ := s.Child("a")
+			convey.So(stillA, convey.ShouldResemble, a)
+			s.Stop()
+			s.Wait()
+		})
+
+		convey.Convey("Restart types", func() {
+			s, _ := agent.StartSupervisor(SupervisorSpec{
+				Children: []ChildSpec{
+					{Id: "transient", Restart: TRANSIENT, Handlers: crashHandlers},
+					{Id: "temporary", Restart: TEMPORARY, Handlers: crashHandlers},
+				},
+			})
+			transient, _ := s.Child("transient")
+			temporary, _ := s.Child("temporary")
+			agent.Send(temporary, []byte("crash"))
+			convey.So(waitFor(func() bool {
+				_, running := s.Child("temporary")
+				return !running
+			}), convey.ShouldBeTrue)
+			agent.Send(transient, []byte(base.REASON_NORMAL))
+			convey.So(waitFor(func() bool {
+				_, running := s.Child("transient")
+				return !running
+			}), convey.ShouldBeTrue)
+			s.Stop()
+			s.Wait()
+		})
+
+		convey.Convey("Restart intensity", func() {
+			s, _ := agent.StartSupervisor(SupervisorSpec{
+				MaxRestarts: 1,
+				Period:      time.Minute,
+				Children: []ChildSpec{
+					{Id: "a", Name: "fragile", Handlers: crashHandlers},
+				},
+			})
+			a, _ := s.Child("a")
+			agent.Send(a, []byte("crash"))
+			a, _ = waitRestarted(s, "a", a)
+			agent.Send(a, []byte("crash"))
+			convey.So(s.Wait(), convey.ShouldEqual, errRestartIntensity.Error())
+			_, exist := agent.WhereIs("fragile")
+			convey.So(exist, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Nested supervisor", func() {
+			s, err := agent.StartSupervisor(SupervisorSpec{
+				Children: []ChildSpec{
+					{Id: "sub", Supervisor: &SupervisorSpec{
+						MaxRestarts: 1,
+						Period:      time.Minute,
+						Children: []ChildSpec{
+							{Id: "leaf", Name: "leaf", Handlers: crashHandlers},
+						},
+					}},
+				},
+			})
+			convey.So(err, convey.ShouldBeNil)
+			sub, _ := s.Child("sub")
+			leaf, _ := agent.WhereIs("leaf")
+			agent.Send(leaf, []byte("crash"))
+			convey.So(waitFor(func() bool {
+				pid, exist := agent.WhereIs("leaf")
+				return exist && pid != leaf
+			}), convey.ShouldBeTrue)
+			leaf, _ = agent.WhereIs("leaf")
+			agent.Send(leaf, []byte("crash"))
+			_, restarted := waitRestarted(s, "sub", sub)
+			convey.So(restarted, convey.ShouldBeTrue)
+			convey.So(waitFor(func() bool {
+				pid, exist := agent.WhereIs("leaf")
+				return exist && pid != leaf
+			}), convey.ShouldBeTrue)
+			s.Stop()
+			s.Wait()
+			_, exist := agent.WhereIs("leaf")
+			convey.So(exist, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("Start failure", func() {
+			agent.RegisterName("taken", agent.NewProcess().routine)
+			_, err := agent.StartSupervisor(SupervisorSpec{
+				Children: []ChildSpec{
+					{Id: "a", Handlers: crashHandlers},
+					{Id: "b", Name: "taken", Handlers: crashHandlers},
+				},
+			})
+			convey.So(err, convey.ShouldEqual, ErrNameRegistered)
+		})
+	})
+}
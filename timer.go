@@ -0,0 +1,136 @@
+package godist
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhuangsirui/godist/base"
+)
+
+// 定时器的引用，用于取消定时器。
+type TimerRef uint64
+
+type timer struct {
+	pid      base.Pid
+	message  []byte
+	interval time.Duration
+	t        *time.Timer
+}
+
+// d 之后向 pid 发送 message 。 pid 为本节点的 Process 时，定时器在其退出时被取消。
+func (agent *Agent) SendAfter(d time.Duration, pid base.Pid, message []byte) TimerRef {
+	return agent.startTimer(d, 0, pid, message)
+}
+
+// SendInterval 的最小间隔。
+const MIN_TIMER_INTERVAL = time.Millisecond
+
+// 每隔 interval 向 pid 发送一次 message ，直到定时器被取消。目标已经退出或者
+// 属于对端之前的运行实例时，定时器自动取消。 interval 小于 MIN_TIMER_INTERVAL 时
+// 按照 MIN_TIMER_INTERVAL 处理。
+func (agent *Agent) SendInterval(interval time.Duration, pid base.Pid, message []byte) TimerRef {
+	if interval < MIN_TIMER_INTERVAL {
+		log.Printf("godist.timer: interval %s to %s is too short, use %s", interval, pid, MIN_TIMER_INTERVAL)
+		interval = MIN_TIMER_INTERVAL
+	}
+	return agent.startTimer(interval, interval, pid, message)
+}
+
+// 取消定时器。定时器已经触发或者已经被取消时返回 false 。
+func (agent *Agent) CancelTimer(ref TimerRef) bool {
+	agent.timerLock.Lock()
+	defer agent.timerLock.Unlock()
+	tm, exist := agent.timers[ref]
+	if !exist {
+		return false
+	}
+	tm.t.Stop()
+	agent.removeTimer(ref, tm)
+	return true
+}
+
+// d 之后向 Process 自己发送 message 。
+func (p *Process) SendAfter(d time.Duration, message []byte) TimerRef {
+	return p.agent.SendAfter(d, p.Pid(), message)
+}
+
+func (agent *Agent) startTimer(d, interval time.Duration, pid base.Pid, message []byte) TimerRef {
+	ref := TimerRef(atomic.AddUint64(&agent.timerCounter, 1))
+	tm := &timer{
+		pid:      pid,
+		message:  message,
+		interval: interval,
+	}
+	agent.timerLock.Lock()
+	defer agent.timerLock.Unlock()
+	agent.timers[ref] = tm
+	if agent.isLocal(pid) {
+		if _, exist := agent.routineTimers[pid.Id]; !exist {
+			agent.routineTimers[pid.Id] = make(map[TimerRef]bool)
+		}
+		agent.routineTimers[pid.Id][ref] = true
+	}
+	tm.t = time.AfterFunc(d, func() { agent.fireTimer(ref) })
+	return ref
+}
+
+func (agent *Agent) fireTimer(ref TimerRef) {
+	agent.timerLock.Lock()
+	tm, exist := agent.timers[ref]
+	if exist && tm.interval == 0 {
+		agent.removeTimer(ref, tm)
+	}
+	agent.timerLock.Unlock()
+	if !exist {
+		return
+	}
+	err := agent.Send(tm.pid, tm.message)
+	if err != nil {
+		log.Printf("godist.timer: send to %s error: %s", tm.pid, err)
+	}
+	if tm.interval == 0 {
+		return
+	}
+	agent.timerLock.Lock()
+	defer agent.timerLock.Unlock()
+	if _, exist := agent.timers[ref]; !exist {
+		// 发送期间被取消。
+		return
+	}
+	if err == ErrRoutineNotFound || err == ErrStalePid {
+		agent.removeTimer(ref, tm)
+		return
+	}
+	tm.t.Reset(tm.interval)
+}
+
+// 需要持有 timerLock 。
+func (agent *Agent) removeTimer(ref TimerRef, tm *timer) {
+	delete(agent.timers, ref)
+	if !agent.isLocal(tm.pid) {
+		return
+	}
+	refs := agent.routineTimers[tm.pid.Id]
+	delete(refs, ref)
+	if len(refs) == 0 {
+		delete(agent.routineTimers, tm.pid.Id)
+	}
+}
+
+// 取消发往本节点 Goroutine 的所有定时器。 Goroutine 退出时调用。
+func (agent *Agent) cancelTimers(routineId base.RoutineId) {
+	agent.timerLock.Lock()
+	defer agent.timerLock.Unlock()
+	for ref := range agent.routineTimers[routineId] {
+		if tm, exist := agent.timers[ref]; exist {
+			tm.t.Stop()
+			delete(agent.timers, ref)
+		}
+	}
+	delete(agent.routineTimers, routineId)
+}
+
+func (agent *Agent) isLocal(pid base.Pid) bool {
+	return pid.Node == agent.Name() && pid.Creation == agent.creation
+}
@@ -0,0 +1,99 @@
+package godist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+func TestTimer(t *testing.T) {
+	convey.Convey("Timer", t, func() {
+		convey.Convey("Send after", func() {
+			agent := New("timer@localhost")
+			process := agent.NewProcess()
+			start := time.Now()
+			process.SendAfter(50*time.Millisecond, []byte("timeout"))
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("timeout"))
+			convey.So(time.Since(start), convey.ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+			convey.So(agent.timers, convey.ShouldBeEmpty)
+		})
+
+		convey.Convey("Cancel timer", func() {
+			agent := New("timer_2@localhost")
+			process := agent.NewProcess()
+			ref := process.SendAfter(50*time.Millisecond, []byte("timeout"))
+			convey.So(agent.CancelTimer(ref), convey.ShouldBeTrue)
+			convey.So(agent.CancelTimer(ref), convey.ShouldBeFalse)
+			_, err := process.ReceiveAfter(100*time.Millisecond, nil)
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(agent.timers, convey.ShouldBeEmpty)
+			convey.So(agent.routineTimers, convey.ShouldBeEmpty)
+		})
+
+		convey.Convey("Send interval", func() {
+			agent := New("timer_3@localhost")
+			process := agent.NewProcess()
+			ref := agent.SendInterval(10*time.Millisecond, process.Pid(), []byte("tick"))
+			for i := 0; i < 3; i++ {
+				message, err := process.ReceiveAfter(time.Second, nil)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(message.Cast, convey.ShouldResemble, []byte("tick"))
+			}
+			convey.So(agent.CancelTimer(ref), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("Non-positive interval", func() {
+			agent := New("timer_5@localhost")
+			process := agent.NewProcess()
+			ref := agent.SendInterval(0, process.Pid(), []byte("tick"))
+			time.Sleep(20 * time.Millisecond)
+			convey.So(agent.CancelTimer(ref), convey.ShouldBeTrue)
+			convey.So(len(process.Channel), convey.ShouldBeGreaterThan, 0)
+			convey.So(len(process.Channel), convey.ShouldBeLessThan, cap(process.Channel))
+		})
+
+		convey.Convey("Timers dropped on exit", func() {
+			agent := New("timer_4@localhost")
+			process := agent.NewProcess()
+			agent.SendAfter(time.Hour, process.Pid(), []byte("timeout"))
+			agent.SendInterval(time.Hour, process.Pid(), []byte("tick"))
+			go process.Run(func([]byte) error { return nil })
+			process.Stop("stop")
+			process.Wait()
+			convey.So(agent.timers, convey.ShouldBeEmpty)
+			convey.So(agent.routineTimers, convey.ShouldBeEmpty)
+		})
+
+		convey.Convey("Remote timer", func() {
+			var gpmdPort uint16 = 1989
+			m := gpmd.New("localhost", gpmdPort)
+			m.Serve()
+			agents := startAgents(gpmdPort, "timer_a", "timer_b")
+			a, b := agents[0], agents[1]
+			process := b.NewProcess()
+			a.SendAfter(10*time.Millisecond, process.Pid(), []byte("timeout"))
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("timeout"))
+
+			// 远程目标退出之后，周期定时器自动取消。
+			a.SendInterval(10*time.Millisecond, process.Pid(), []byte("tick"))
+			go process.Run(func([]byte) error { return nil })
+			process.Stop("stop")
+			process.Wait()
+			convey.So(waitFor(func() bool {
+				a.timerLock.Lock()
+				defer a.timerLock.Unlock()
+				return len(a.timers) == 0
+			}), convey.ShouldBeTrue)
+
+			stopAgents(agents)
+			m.Stop()
+			m.Stopped()
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package godist
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// 使用 TLS 加密节点之间的连接，双方都需要出示证书。 config 需要设置本节点的
+// Certificates 和用于校验对端证书的 RootCAs ； ClientCAs 为 nil 时同样使用
+// RootCAs 。证书的 CommonName 或者 DNSNames 中需要包含节点名，连接时校验对端
+// 证书与其节点名是否一致。接入的连接在 REQ_CONN 成功之前只能发送握手请求。需要在
+// Listen 和建立连接之前调用。
+func (a *Agent) SetTLS(config *tls.Config) {
+	a.tlsConfig = config
+}
+
+// 作为接收方包装连接。没有设置 TLS 时原样返回。
+func (agent *Agent) secureServer(tcpConn *net.TCPConn) net.Conn {
+	if agent.tlsConfig == nil {
+		return tcpConn
+	}
+	config := agent.tlsConfig.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if config.ClientCAs == nil {
+		config.ClientCAs = config.RootCAs
+	}
+	// 对端的节点名在握手之后的 REQ_CONN 中才能得知，见 Agent.handleConnect 。
+	return tls.Server(tcpConn, config)
+}
+
+// 作为发起方包装连接并完成握手，校验对端证书属于节点 name 。没有设置 TLS 时原样
+// 返回。
+func (agent *Agent) secureClient(tcpConn *net.TCPConn, name string) (net.Conn, error) {
+	if agent.tlsConfig == nil {
+		return tcpConn, nil
+	}
+	config := agent.tlsConfig.Clone()
+	// 节点名不是主机名，由 VerifyConnection 代替默认的校验。
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		return verifyPeer(state.PeerCertificates, config.RootCAs, name)
+	}
+	tlsConn := tls.Client(tcpConn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		tcpConn.Close()
+		log.Printf("godist.tls handshake with %s error: %s", name, err)
+		if errors.Is(err, ErrIdentityMismatch) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrNodeUnreachable, err)
+	}
+	return tlsConn, nil
+}
+
+func verifyPeer(certificates []*x509.Certificate, roots *x509.CertPool, name string) error {
+	if len(certificates) == 0 {
+		return ErrIdentityMismatch
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return err
+	}
+	if !certificateOf(certificates[0], name) {
+		return ErrIdentityMismatch
+	}
+	return nil
+}
+
+// 证书的 CommonName 或者 DNSNames 中是否包含节点名。
+func certificateOf(certificate *x509.Certificate, name string) bool {
+	if certificate.Subject.CommonName == name {
+		return true
+	}
+	for _, dnsName := range certificate.DNSNames {
+		if dnsName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验接入的连接出示的证书属于其声明的节点 name 。没有设置 TLS 时不做校验。
+func (agent *Agent) verifyClient(conn *connection, name string) error {
+	if agent.tlsConfig == nil {
+		return nil
+	}
+	tlsConn, ok := conn.conn.(*tls.Conn)
+	if !ok {
+		return ErrIdentityMismatch
+	}
+	// 证书链已经在握手时按照 ClientCAs 校验过了。
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 || !certificateOf(certificates[0], name) {
+		return ErrIdentityMismatch
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package godist
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/zhuangsirui/godist/gpmd"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+}
+
+func newTestCA() *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "godist test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	certificate, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &testCA{certificate, key, pool}
+}
+
+// 为节点 name 签发证书，返回该节点使用的 TLS 设置。
+func (ca *testCA) config(name string) *tls.Config {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.pool,
+	}
+}
+
+func TestTLS(t *testing.T) {
+	convey.Convey("TLS", t, func() {
+		var gpmdPort uint16 = 1989
+		m := gpmd.New("localhost", gpmdPort)
+		m.Serve()
+		ca := newTestCA()
+		agents := startAgentsWith(gpmdPort, func(agent *Agent) {
+			agent.SetTLS(ca.config(agent.Name()))
+		}, "tls_a", "tls_b")
+		a, b := agents[0], agents[1]
+
+		// 启动一个不在 agents 中的节点。
+		start := func(name string, config *tls.Config) *Agent {
+			agent := New(name + "@localhost")
+			agent.SetGPMD("localhost", gpmdPort)
+			agent.SetTLS(config)
+			agent.Listen()
+			agent.Register()
+			go agent.Serve()
+			return agent
+		}
+
+		convey.Convey("Mutual authentication", func() {
+			process := b.NewProcess()
+			convey.So(a.Send(process.Pid(), []byte("secret")), convey.ShouldBeNil)
+			message, err := process.ReceiveAfter(time.Second, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(message.Cast, convey.ShouldResemble, []byte("secret"))
+			conn, _ := a.findConn(b.Name())
+			_, ok := conn.conn.(*tls.Conn)
+			convey.So(ok, convey.ShouldBeTrue)
+		})
+
+		convey.Convey("Client claims another name", func() {
+			evil := start("tls_evil", ca.config("tls_a"))
+			convey.So(evil.QueryNode(b.Node().FullName()), convey.ShouldBeNil)
+			err := evil.ConnectTo(b.Name())
+			convey.So(err, convey.ShouldEqual, ErrConnectionClosed)
+			convey.So(b.connExist(evil.Name()), convey.ShouldBeFalse)
+			stopAgents([]*Agent{evil})
+		})
+
+		convey.Convey("Server certificate of another node", func() {
+			evil := start("tls_c", ca.config("tls_b"))
+			convey.So(a.QueryNode(evil.Node().FullName()), convey.ShouldBeNil)
+			err := a.ConnectTo(evil.Name())
+			convey.So(err, convey.ShouldEqual, ErrIdentityMismatch)
+			stopAgents([]*Agent{evil})
+		})
+
+		convey.Convey("Untrusted certificate", func() {
+			evil := start("tls_d", newTestCA().config("tls_d"))
+			convey.So(a.QueryNode(evil.Node().FullName()), convey.ShouldBeNil)
+			err := a.ConnectTo(evil.Name())
+			convey.So(errors.Is(err, ErrNodeUnreachable), convey.ShouldBeTrue)
+			convey.So(evil.QueryNode(b.Node().FullName()), convey.ShouldBeNil)
+			convey.So(evil.ConnectTo(b.Name()), convey.ShouldNotBeNil)
+			convey.So(b.connExist(evil.Name()), convey.ShouldBeFalse)
+			stopAgents([]*Agent{evil})
+		})
+
+		convey.Convey("Plaintext client", func() {
+			plain := start("tls_plain", nil)
+			convey.So(plain.QueryNode(b.Node().FullName()), convey.ShouldBeNil)
+			convey.So(plain.ConnectTo(b.Name()), convey.ShouldNotBeNil)
+			convey.So(b.connExist(plain.Name()), convey.ShouldBeFalse)
+			stopAgents([]*Agent{plain})
+		})
+
+		convey.Convey("Requests before handshake", func() {
+			raw := New("tls_raw@localhost")
+			raw.SetTLS(ca.config(raw.Name()))
+			address := fmt.Sprintf("%s:%d", b.Host(), b.Port())
+			tcpAddr, _ := net.ResolveTCPAddr("tcp", address)
+			tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+			convey.So(err, convey.ShouldBeNil)
+			netConn, err := raw.secureClient(tcpConn, b.Name())
+			convey.So(err, convey.ShouldBeNil)
+			client := newConnection(raw, netConn)
+			client.start()
+			process := b.NewProcess()
+			_, err = client.request(REQ_CAST, castBody(process, []byte("inject")))
+			convey.So(err, convey.ShouldEqual, ErrConnectionClosed)
+			convey.So(process.Channel, convey.ShouldBeEmpty)
+		})
+
+		stopAgents(agents)
+		m.Stop()
+		m.Stopped()
+	})
+}